@@ -2,10 +2,34 @@ package log_v1
 
 import (
 	"fmt"
+	"time"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// segmentFullRetryDelay is how long a client should wait to retry an
+	// append that found the active segment full
+	segmentFullRetryDelay = 10 * time.Millisecond
+	// logClosedRetryDelay is how long a client should wait to retry a
+	// request to a server whose log is closed, e.g. while restarting
+	logClosedRetryDelay = time.Second
+	// notEnoughReplicasRetryDelay is how long a client should wait to
+	// retry an append while too few replicas are in sync
+	notEnoughReplicasRetryDelay = time.Second
+)
+
+const (
+	// errorDomain qualifies the reasons of the errors' ErrorInfo details
+	errorDomain = "proglog"
+	// notLeaderReason is the ErrorInfo reason of ErrNotLeader
+	notLeaderReason = "NOT_LEADER"
+	// leaderAddrKey holds the leader's address in ErrNotLeader's ErrorInfo
+	leaderAddrKey = "leader_addr"
 )
 
 type ErrOffsetOutOfRange struct {
@@ -21,17 +45,320 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 		"The requested offset is outside the log range: %d",
 		e.Offset,
 	)
-	d := errdetails.LocalizedMessage{
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrOffsetOutOfRange) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOutOfOrderSequence struct {
+	ProducerId uint64
+	Sequence   uint64
+	Expected   uint64
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"out of order sequence for producer %d: %d",
+			e.ProducerId,
+			e.Sequence,
+		),
+	)
+	msg := fmt.Sprintf(
+		"The producer %d sent sequence %d but the next expected sequence is %d",
+		e.ProducerId,
+		e.Sequence,
+		e.Expected,
+	)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTransactionNotOpen struct {
+	TransactionId uint64
+}
+
+func (e ErrTransactionNotOpen) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("transaction not open: %d", e.TransactionId),
+	)
+	msg := fmt.Sprintf(
+		"The transaction %d was never begun or has already ended",
+		e.TransactionId,
+	)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrTransactionNotOpen) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrGroupNotFound struct {
+	Group string
+}
+
+func (e ErrGroupNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("group not found: %s", e.Group),
+	)
+	msg := fmt.Sprintf(
+		"The consumer group %q has not committed an offset",
+		e.Group,
+	)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrGroupNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrSegmentFull struct {
+	BaseOffset uint64
+}
+
+func (e ErrSegmentFull) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.ResourceExhausted,
+		fmt.Sprintf("segment full: %d", e.BaseOffset),
+	)
+	msg := fmt.Sprintf(
+		"The segment starting at offset %d has no room for the record",
+		e.BaseOffset,
+	)
+	return withDetails(
+		st,
+		localizedMessage(msg),
+		&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(segmentFullRetryDelay),
+		},
+	)
+}
+
+func (e ErrSegmentFull) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrCorruptRecord struct {
+	Offset uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.DataLoss,
+		fmt.Sprintf("corrupt record: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record at offset %d could not be decoded from disk",
+		e.Offset,
+	)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrLogClosed struct{}
+
+func (e ErrLogClosed) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, "log closed")
+	return withDetails(
+		st,
+		localizedMessage("The log is closed and no longer serving requests"),
+		&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(logClosedRetryDelay),
+		},
+	)
+}
+
+func (e ErrLogClosed) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("topic not found: %s", e.Topic),
+	)
+	msg := fmt.Sprintf("The topic %q does not exist", e.Topic)
+	return withDetails(
+		st,
+		localizedMessage(msg),
+		&errdetails.ResourceInfo{
+			ResourceType: "topic",
+			ResourceName: e.Topic,
+			Description:  msg,
+		},
+	)
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrServerNotFound struct {
+	Id string
+}
+
+func (e ErrServerNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("server not found: %s", e.Id),
+	)
+	msg := fmt.Sprintf("The cluster has no server %q", e.Id)
+	return withDetails(
+		st,
+		localizedMessage(msg),
+		&errdetails.ResourceInfo{
+			ResourceType: "server",
+			ResourceName: e.Id,
+			Description:  msg,
+		},
+	)
+}
+
+func (e ErrServerNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrRecordTooLarge struct {
+	Size uint64
+	Max  uint64
+}
+
+func (e ErrRecordTooLarge) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("record too large: %d", e.Size),
+	)
+	msg := fmt.Sprintf(
+		"The record is %d bytes but at most %d bytes are allowed",
+		e.Size,
+		e.Max,
+	)
+	return withDetails(
+		st,
+		localizedMessage(msg),
+		&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+				Field:       "record",
+				Description: msg,
+			}},
+		},
+	)
+}
+
+func (e ErrRecordTooLarge) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrNotEnoughReplicas struct {
+	InSync uint64
+	Min    uint64
+}
+
+func (e ErrNotEnoughReplicas) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.Unavailable,
+		fmt.Sprintf("not enough in-sync replicas: %d", e.InSync),
+	)
+	msg := fmt.Sprintf(
+		"Only %d replicas are in sync but appending with all acks requires %d",
+		e.InSync,
+		e.Min,
+	)
+	return withDetails(
+		st,
+		localizedMessage(msg),
+		&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(notEnoughReplicasRetryDelay),
+		},
+	)
+}
+
+func (e ErrNotEnoughReplicas) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotLeader is returned by a follower of a replicated log asked for what
+// only the leader can do: to change the cluster, or to append when it
+// redirects clients rather than forwarding their requests. The client
+// should retry against the leader at LeaderAddr, which LeaderAddr recovers
+// from the error.
+type ErrNotLeader struct {
+	LeaderAddr string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("not the leader, leader is %s", e.LeaderAddr),
+	)
+	msg := fmt.Sprintf(
+		"Only the cluster's leader at %s can serve the request",
+		e.LeaderAddr,
+	)
+	return withDetails(
+		st,
+		localizedMessage(msg),
+		&errdetails.ErrorInfo{
+			Reason:   notLeaderReason,
+			Domain:   errorDomain,
+			Metadata: map[string]string{leaderAddrKey: e.LeaderAddr},
+		},
+	)
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// LeaderAddr returns the leader's address an ErrNotLeader redirected the
+// client to, including one received over gRPC, and whether err is one.
+func LeaderAddr(err error) (string, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return "", false
+	}
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if ok && info.Domain == errorDomain && info.Reason == notLeaderReason {
+			return info.Metadata[leaderAddrKey], true
+		}
+	}
+	return "", false
+}
+
+// withLocalizedMessage attaches a human readable message to the status
+func withLocalizedMessage(st *status.Status, msg string) *status.Status {
+	return withDetails(st, localizedMessage(msg))
+}
+
+func localizedMessage(msg string) *errdetails.LocalizedMessage {
+	return &errdetails.LocalizedMessage{
 		Locale:  "en-us",
 		Message: msg,
 	}
-	std, err := st.WithDetails(&d)
+}
+
+// withDetails attaches the details to the status, falling back to the bare
+// status if they cannot be encoded
+func withDetails(st *status.Status, details ...protoiface.MessageV1) *status.Status {
+	std, err := st.WithDetails(details...)
 	if err != nil {
 		return st
 	}
 	return std
 }
-
-func (e ErrOffsetOutOfRange) Error() string {
-	return e.GRPCStatus().Err().Error()
-}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/mstreet3/proglog/internal/agent"
+	"github.com/mstreet3/proglog/internal/config"
+)
+
+func main() {
+	cli := &cli{}
+	cmd := &cobra.Command{
+		Use:     "proglog",
+		Short:   "Serve a commit log over gRPC and HTTP",
+		PreRunE: cli.setupConfig,
+		RunE:    cli.run,
+		// main logs the error, which isn't a usage error
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	if err := setupFlags(cmd); err != nil {
+		log.Fatal(err)
+	}
+	if err := cmd.Execute(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type cli struct {
+	cfg agent.Config
+}
+
+// setupFlags defines the command's flags. Each can also be set in the
+// config file by its name, or by an environment variable named after it
+// with a PROGLOG_ prefix, e.g. PROGLOG_DATA_DIR for --data-dir.
+func setupFlags(cmd *cobra.Command) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	cmd.Flags().String("config-file", "", "Path to a YAML config file.")
+	cmd.Flags().String("data-dir", "data", "Directory to store the log in.")
+	cmd.Flags().String("topic", "", "Name of the log's topic.")
+	cmd.Flags().Uint64("segment-max-store-bytes", 1<<20, "Maximum size of a segment's store.")
+	cmd.Flags().Uint64("segment-max-index-bytes", 1<<20, "Maximum size of a segment's index.")
+	cmd.Flags().Uint64("segment-max-record-bytes", 0, "Maximum size of a record, zero for no limit.")
+	cmd.Flags().String("grpc-addr", ":8400", "Address to serve gRPC on.")
+	cmd.Flags().String("http-addr", ":8080", "Address to serve HTTP on.")
+	cmd.Flags().String("metrics-addr", ":9400", "Address to serve Prometheus metrics on, empty to disable.")
+	cmd.Flags().String("log-level", "info", "Level of the request log: debug, info, warn or error.")
+	cmd.Flags().String("trace-file", "", "File to write request traces to as JSON, - for stdout.")
+	cmd.Flags().String("server-tls-cert-file", "", "Path to the server's TLS certificate.")
+	cmd.Flags().String("server-tls-key-file", "", "Path to the server's TLS key.")
+	cmd.Flags().String("server-tls-ca-file", "", "Path to the CA of gRPC client certificates.")
+	cmd.Flags().String("acl-model-file", "", "Path to the ACL model.")
+	cmd.Flags().String("acl-policy-file", "", "Path to the ACL policy.")
+	cmd.Flags().String("api-keys", "", "Path to the CSV of HTTP API keys.")
+	cmd.Flags().String("api-secret", "", "Secret the HTTP API keys are signed with.")
+	cmd.Flags().Uint64("min-free-disk-bytes", 64<<20, "Free space the data directory's disk needs to report ready.")
+	cmd.Flags().Duration("shutdown-timeout", 30*time.Second, "How long to wait for requests on shutdown.")
+	cmd.Flags().String("node-name", hostname, "Unique name of the server in its cluster.")
+	cmd.Flags().String("bind-addr", "", "Address to gossip with the cluster on, empty to run alone.")
+	cmd.Flags().StringSlice("start-join-addrs", nil, "Gossip addresses of servers to join the cluster through.")
+	cmd.Flags().Bool("bootstrap", false, "Start a new cluster with this server.")
+	cmd.Flags().String("peer-tls-cert-file", "", "Path to the certificate presented to the other servers.")
+	cmd.Flags().String("peer-tls-key-file", "", "Path to the key of the peer certificate.")
+	cmd.Flags().String("peer-tls-ca-file", "", "Path to the CA of the other servers' certificates.")
+	cmd.Flags().Uint64("min-insync-replicas", 1, "Replicas that must be in sync to produce with all acks, set on the topic by the bootstrapping server.")
+	cmd.Flags().Duration("replica-lag-timeout", 10*time.Second, "How long a follower may lag before it's out of sync.")
+	cmd.Flags().Bool("redirect-produce", false, "Refuse produce requests on followers, naming the leader, rather than forwarding them.")
+	viper.SetEnvPrefix("proglog")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+	return viper.BindPFlags(cmd.Flags())
+}
+
+func (c *cli) setupConfig(cmd *cobra.Command, args []string) error {
+	// Read the config file when one is given
+	if file := viper.GetString("config-file"); file != "" {
+		viper.SetConfigFile(file)
+		if err := viper.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+
+	c.cfg.DataDir = viper.GetString("data-dir")
+	c.cfg.Topic = viper.GetString("topic")
+	c.cfg.Log.Segment.MaxStoreBytes = viper.GetUint64("segment-max-store-bytes")
+	c.cfg.Log.Segment.MaxIndexBytes = viper.GetUint64("segment-max-index-bytes")
+	c.cfg.Log.Segment.MaxRecordBytes = viper.GetUint64("segment-max-record-bytes")
+	c.cfg.GRPCAddr = viper.GetString("grpc-addr")
+	c.cfg.HTTPAddr = viper.GetString("http-addr")
+	c.cfg.MetricsAddr = viper.GetString("metrics-addr")
+	c.cfg.TraceFile = viper.GetString("trace-file")
+	c.cfg.ServerTLSConfig = config.TLSConfig{
+		CertFile: viper.GetString("server-tls-cert-file"),
+		KeyFile:  viper.GetString("server-tls-key-file"),
+		CAFile:   viper.GetString("server-tls-ca-file"),
+		Server:   true,
+	}
+	c.cfg.ACLModelFile = viper.GetString("acl-model-file")
+	c.cfg.ACLPolicyFile = viper.GetString("acl-policy-file")
+	c.cfg.APIKeysFile = viper.GetString("api-keys")
+	c.cfg.APISecret = viper.GetString("api-secret")
+	c.cfg.MinFreeDiskBytes = viper.GetUint64("min-free-disk-bytes")
+	c.cfg.ShutdownTimeout = viper.GetDuration("shutdown-timeout")
+	c.cfg.NodeName = viper.GetString("node-name")
+	c.cfg.BindAddr = viper.GetString("bind-addr")
+	c.cfg.StartJoinAddrs = viper.GetStringSlice("start-join-addrs")
+	c.cfg.Bootstrap = viper.GetBool("bootstrap")
+	c.cfg.PeerTLSConfig = config.TLSConfig{
+		CertFile: viper.GetString("peer-tls-cert-file"),
+		KeyFile:  viper.GetString("peer-tls-key-file"),
+		CAFile:   viper.GetString("peer-tls-ca-file"),
+	}
+	c.cfg.MinInSyncReplicas = viper.GetUint64("min-insync-replicas")
+	c.cfg.Log.Raft.ReplicaLagTimeout = viper.GetDuration("replica-lag-timeout")
+	c.cfg.RedirectProduce = viper.GetBool("redirect-produce")
+
+	if c.cfg.APIKeysFile != "" && c.cfg.APISecret == "" {
+		return fmt.Errorf("api-secret is required with api-keys")
+	}
+	if c.cfg.MinInSyncReplicas < 1 {
+		return fmt.Errorf("min-insync-replicas must be at least 1")
+	}
+
+	// Log JSON to stderr at the configured level
+	var level zapcore.Level
+	if err := level.Set(viper.GetString("log-level")); err != nil {
+		return err
+	}
+	logConfig := zap.NewProductionConfig()
+	logConfig.Level = zap.NewAtomicLevelAt(level)
+	logger, err := logConfig.Build()
+	if err != nil {
+		return err
+	}
+	c.cfg.Logger = logger
+	return os.MkdirAll(c.cfg.DataDir, 0755)
+}
+
+func (c *cli) run(cmd *cobra.Command, args []string) error {
+	logger := c.cfg.Logger
+	defer logger.Sync()
+	a, err := agent.New(c.cfg)
+	if err != nil {
+		return err
+	}
+	logger.Info(
+		"serving",
+		zap.String("grpc_addr", c.cfg.GRPCAddr),
+		zap.String("http_addr", c.cfg.HTTPAddr),
+		zap.String("metrics_addr", c.cfg.MetricsAddr),
+		zap.String("bind_addr", c.cfg.BindAddr),
+	)
+
+	// Shut down gracefully on SIGINT and SIGTERM, or once a server fails
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-sigc:
+		logger.Info("shutting down", zap.Stringer("signal", sig))
+	case err := <-a.Errors():
+		logger.Error("server failed, shutting down", zap.Error(err))
+		if serr := a.Shutdown(); serr != nil {
+			logger.Error("shutdown failed", zap.Error(serr))
+		}
+		return err
+	}
+	return a.Shutdown()
+}
@@ -0,0 +1,575 @@
+// Package agent runs a proglog server: the persistent log and the gRPC
+// and HTTP servers that share it, and optionally the cluster membership
+// that replicates the log with the other servers.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/soheilhy/cmux"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+
+	api "github.com/mstreet3/proglog/api/v1"
+	"github.com/mstreet3/proglog/internal/auth"
+	"github.com/mstreet3/proglog/internal/config"
+	"github.com/mstreet3/proglog/internal/discovery"
+	"github.com/mstreet3/proglog/internal/health"
+	"github.com/mstreet3/proglog/internal/log"
+	"github.com/mstreet3/proglog/internal/metrics"
+	"github.com/mstreet3/proglog/internal/server"
+	"github.com/mstreet3/proglog/internal/tracing"
+)
+
+// Config configures an Agent. TLS is served when ServerTLSConfig names a
+// certificate; gRPC clients must then present certificates signed by its
+// CA, which the ACL files authorize. HTTP clients must present API keys
+// when APIKeysFile is set. Prometheus metrics are served on MetricsAddr
+// when it's set, outside the API's authentication. Request traces are
+// written as JSON to TraceFile when it's set, "-" meaning stdout. Every
+// request is logged to Logger when it's set. The server reports itself
+// ready over grpc.health.v1 and /readyz while the log is open and, when
+// MinFreeDiskBytes is set, its disk has that much space free.
+//
+// When BindAddr is set the agent joins a cluster, gossiping on BindAddr
+// with the agents at StartJoinAddrs, and replicates the log with Raft. Raft
+// shares GRPCAddr with the gRPC server, so it must be an address the other
+// agents can reach; they connect to it with the PeerTLSConfig certificate
+// when TLS is served. Produce requests sent to a follower are forwarded to
+// the leader with that certificate too, which the leader's ACL must allow
+// to produce, unless RedirectProduce is set. Followers then refuse them,
+// naming the leader for the client to retry against. A clustered agent is
+// only ready while it keeps up with the entries its leader has committed.
+type Config struct {
+	DataDir          string
+	Log              log.Config
+	Topic            string
+	GRPCAddr         string
+	HTTPAddr         string
+	MetricsAddr      string
+	TraceFile        string
+	Logger           *zap.Logger
+	MinFreeDiskBytes uint64
+	ServerTLSConfig  config.TLSConfig
+	ACLModelFile     string
+	ACLPolicyFile    string
+	APIKeysFile      string
+	APISecret        string
+	// ShutdownTimeout bounds how long Shutdown waits for in-flight
+	// requests before closing their connections
+	ShutdownTimeout time.Duration
+	NodeName        string
+	BindAddr        string
+	StartJoinAddrs  []string
+	// Bootstrap starts a new cluster with this agent as its first server
+	Bootstrap bool
+	// MinInSyncReplicas is the topic's min_insync_replicas, which the
+	// bootstrapping agent configures the topic with each time it starts,
+	// leaving the topic's setting as it is when zero. The topic's setting
+	// is replicated with the log, so every server enforces the same one.
+	MinInSyncReplicas uint64
+	PeerTLSConfig     config.TLSConfig
+	RedirectProduce   bool
+}
+
+// commitLog is the log an agent serves, either local or replicated
+type commitLog interface {
+	server.CommitLog
+	Ready() error
+	Stats() log.Stats
+	Close() error
+}
+
+// Agent runs the log and its servers until it's shut down.
+type Agent struct {
+	Config
+
+	log           commitLog
+	distributed   *log.DistributedLog
+	membership    *discovery.Membership
+	mux           cmux.CMux
+	repo          *server.LogRepository
+	metrics       *metrics.Metrics
+	health        *health.Checker
+	traces        *sdktrace.TracerProvider
+	traceFile     io.WriteCloser
+	grpcServer    *grpc.Server
+	httpServer    *http.Server
+	metricsServer *http.Server
+	grpcLn        net.Listener
+	httpLn        net.Listener
+	metricsLn     net.Listener
+
+	errs         chan error
+	shutdown     bool
+	shutdowns    chan struct{}
+	shutdownLock sync.Mutex
+}
+
+// New opens the log in the data directory and starts serving it.
+func New(config Config) (*Agent, error) {
+	a := &Agent{
+		Config: config,
+		// Room for every server's error, so none of them blocks
+		errs:      make(chan error, 4),
+		shutdowns: make(chan struct{}),
+	}
+	setup := []func() error{
+		a.setupTracing,
+		a.setupMetrics,
+		a.setupMux,
+		a.setupLog,
+		a.setupServers,
+		a.setupHealth,
+		a.setupMembership,
+	}
+	for _, fn := range setup {
+		if err := fn(); err != nil {
+			a.Shutdown()
+			return nil, err
+		}
+	}
+	go a.serve()
+	return a, nil
+}
+
+func (a *Agent) setupTracing() error {
+	switch a.TraceFile {
+	case "":
+		return nil
+	case "-":
+		a.traceFile = os.Stdout
+	default:
+		f, err := os.OpenFile(
+			a.TraceFile,
+			os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+			0644,
+		)
+		if err != nil {
+			return err
+		}
+		a.traceFile = f
+	}
+	var err error
+	a.traces, err = tracing.NewProvider(a.traceFile)
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(a.traces)
+	return nil
+}
+
+func (a *Agent) setupMetrics() error {
+	if a.MetricsAddr == "" {
+		return nil
+	}
+	a.metrics = metrics.New()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", a.metrics.Handler())
+	a.metricsServer = &http.Server{Addr: a.MetricsAddr, Handler: mux}
+	var err error
+	a.metricsLn, err = net.Listen("tcp", a.MetricsAddr)
+	return err
+}
+
+// setupMux listens on the gRPC address, sharing it with Raft when the
+// agent is clustered
+func (a *Agent) setupMux() error {
+	var err error
+	if a.grpcLn, err = net.Listen("tcp", a.GRPCAddr); err != nil {
+		return err
+	}
+	if a.BindAddr != "" {
+		a.mux = cmux.New(a.grpcLn)
+	}
+	return nil
+}
+
+func (a *Agent) setupLog() error {
+	logConfig := a.Config.Log
+	if a.metrics != nil {
+		logConfig.OnSync = a.metrics.ObserveSync
+	}
+	if a.BindAddr != "" {
+		if err := a.setupDistributedLog(logConfig); err != nil {
+			return err
+		}
+	} else {
+		// A log that failed to set up can't be closed on shutdown
+		l, err := log.NewLog(a.DataDir, logConfig)
+		if err != nil {
+			return err
+		}
+		a.log = l
+	}
+	if a.metrics == nil {
+		return nil
+	}
+	topic := a.Topic
+	if topic == "" {
+		topic = server.DefaultTopic
+	}
+	return a.metrics.AddLog(topic, a.log)
+}
+
+// setupDistributedLog replicates the log with Raft over the connections
+// to the gRPC address that start with log.RaftRPC
+func (a *Agent) setupDistributedLog(logConfig log.Config) error {
+	raftLn := a.mux.Match(func(reader io.Reader) bool {
+		b := make([]byte, 1)
+		if _, err := reader.Read(b); err != nil {
+			return false
+		}
+		return bytes.Equal(b, []byte{byte(log.RaftRPC)})
+	})
+	var serverTLS, peerTLS *tls.Config
+	if a.ServerTLSConfig.CertFile != "" {
+		serverTLSConfig := a.ServerTLSConfig
+		serverTLSConfig.Server = true
+		var err error
+		if serverTLS, err = config.SetupTLSConfig(serverTLSConfig); err != nil {
+			return err
+		}
+		if peerTLS, err = config.SetupTLSConfig(a.PeerTLSConfig); err != nil {
+			return err
+		}
+	}
+	logConfig.Raft.StreamLayer = log.NewStreamLayer(raftLn, serverTLS, peerTLS)
+	logConfig.Raft.LocalID = raft.ServerID(a.NodeName)
+	logConfig.Raft.Bootstrap = a.Bootstrap
+	if a.Logger != nil {
+		raftLog, err := zap.NewStdLogAt(a.Logger.Named("raft"), zapcore.DebugLevel)
+		if err != nil {
+			return err
+		}
+		logConfig.Raft.LogOutput = raftLog.Writer()
+	}
+	var err error
+	a.distributed, err = log.NewDistributedLog(a.DataDir, logConfig)
+	if err != nil {
+		return err
+	}
+	a.log = a.distributed
+	if !a.Bootstrap {
+		return nil
+	}
+	if err = a.distributed.WaitForLeader(3 * time.Second); err != nil {
+		return err
+	}
+	if a.MinInSyncReplicas == 0 {
+		return nil
+	}
+	return a.distributed.ConfigureTopic(context.Background(), &api.TopicConfig{
+		MinInsyncReplicas: a.MinInSyncReplicas,
+	})
+}
+
+func (a *Agent) setupServers() error {
+	repo := &server.LogRepository{
+		CommitLog: a.log,
+		Topic:     a.Topic,
+		Logger:    a.Logger,
+	}
+	if a.distributed != nil {
+		repo.GetServerer = a.distributed
+		repo.Leader = a.distributed
+		repo.Cluster = a.distributed
+		repo.RedirectProduce = a.RedirectProduce
+		opts, err := a.leaderDialOptions()
+		if err != nil {
+			return err
+		}
+		repo.LeaderDialOptions = opts
+	}
+	a.repo = repo
+
+	// Authorize gRPC clients by their certificates
+	if a.ACLModelFile != "" {
+		authorizer, err := auth.New(a.ACLModelFile, a.ACLPolicyFile)
+		if err != nil {
+			return err
+		}
+		repo.Authorizer = authorizer
+	}
+	var opts []grpc.ServerOption
+	if a.ServerTLSConfig.CertFile != "" {
+		creds, err := config.ServerOption(a.ServerTLSConfig)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, creds)
+	}
+	if a.metrics != nil {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(a.metrics.UnaryServerInterceptor),
+			grpc.ChainStreamInterceptor(a.metrics.StreamServerInterceptor),
+		)
+	}
+	if a.traces != nil {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(tracing.UnaryServerInterceptor),
+			grpc.ChainStreamInterceptor(tracing.StreamServerInterceptor),
+		)
+	}
+	var err error
+	a.grpcServer, err = server.NewGRPCServer(repo, opts...)
+	if err != nil {
+		return err
+	}
+
+	// Authorize HTTP clients by their API keys
+	var keys server.KeyStore
+	if a.APIKeysFile != "" {
+		ks, err := auth.NewKeyStore(a.APIKeysFile, []byte(a.APISecret))
+		if err != nil {
+			return err
+		}
+		keys = ks
+	}
+	a.httpServer, err = server.NewHTTPServer(a.HTTPAddr, repo, keys)
+	if err != nil {
+		return err
+	}
+	if a.traces != nil {
+		a.httpServer.Handler = tracing.Handler(a.httpServer.Handler)
+	}
+	if a.metrics != nil {
+		a.httpServer.Handler = a.metrics.InstrumentHTTP(a.httpServer.Handler)
+	}
+
+	// Listen before serving so the addresses are in use once New returns
+	if a.httpLn, err = net.Listen("tcp", a.HTTPAddr); err != nil {
+		return err
+	}
+	if a.ServerTLSConfig.CertFile != "" {
+		// HTTP clients authenticate with API keys rather than certificates
+		tlsConfig := a.ServerTLSConfig
+		tlsConfig.CAFile = ""
+		tlsConfig.Server = true
+		httpTLS, err := config.SetupTLSConfig(tlsConfig)
+		if err != nil {
+			return err
+		}
+		a.httpLn = tls.NewListener(a.httpLn, httpTLS)
+	}
+	return nil
+}
+
+// leaderDialOptions configure the connection followers forward produce
+// requests to the leader over
+func (a *Agent) leaderDialOptions() ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+	if a.ServerTLSConfig.CertFile != "" {
+		creds, err := config.DialOption(a.PeerTLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, creds)
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if a.traces != nil {
+		opts = append(opts,
+			grpc.WithChainUnaryInterceptor(tracing.UnaryClientInterceptor),
+		)
+	}
+	return opts, nil
+}
+
+// healthInterval is how often the gRPC health status is rechecked
+const healthInterval = 5 * time.Second
+
+func (a *Agent) setupHealth() error {
+	checks := []health.Check{{Name: "log", Check: a.log.Ready}}
+	if a.distributed != nil {
+		// Clustered nodes serve reads once they've caught up with the leader
+		checks = append(checks, health.Check{
+			Name:  "raft",
+			Check: a.distributed.CaughtUp,
+		})
+	}
+	if a.MinFreeDiskBytes > 0 {
+		checks = append(checks, health.DiskSpace(a.DataDir, a.MinFreeDiskBytes))
+	}
+	a.health = health.New(healthInterval, checks...)
+	a.health.Register(a.grpcServer)
+
+	// Probes are answered ahead of the API and its authentication
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", a.health.Healthz)
+	mux.HandleFunc("/readyz", a.health.Readyz)
+	mux.Handle("/", a.httpServer.Handler)
+	a.httpServer.Handler = mux
+	return nil
+}
+
+// setupMembership joins the cluster, adding the agents that join it to
+// the Raft cluster while this one leads it
+func (a *Agent) setupMembership() error {
+	if a.BindAddr == "" {
+		return nil
+	}
+	var err error
+	a.membership, err = discovery.New(a.distributed, discovery.Config{
+		NodeName: a.NodeName,
+		BindAddr: a.BindAddr,
+		Tags: map[string]string{
+			discovery.RPCAddrTag: a.GRPCAddr,
+		},
+		StartJoinAddrs: a.StartJoinAddrs,
+		Logger:         a.Logger,
+	})
+	return err
+}
+
+func (a *Agent) serve() {
+	if a.mux != nil {
+		grpcLn := a.mux.Match(cmux.Any())
+		a.goServe(func() error { return a.grpcServer.Serve(grpcLn) })
+		a.goServe(a.mux.Serve)
+	} else {
+		a.goServe(func() error { return a.grpcServer.Serve(a.grpcLn) })
+	}
+	a.goServe(func() error { return a.httpServer.Serve(a.httpLn) })
+	if a.metricsServer != nil {
+		a.goServe(func() error { return a.metricsServer.Serve(a.metricsLn) })
+	}
+}
+
+// goServe runs a server in the background, sending the error it fails with
+// to Errors unless it was closed by Shutdown
+func (a *Agent) goServe(serve func() error) {
+	go func() {
+		err := serve()
+		if err == nil || closed(err) {
+			return
+		}
+		select {
+		case <-a.shutdowns:
+			// The servers are expected to stop now
+			return
+		default:
+		}
+		a.errs <- err
+	}()
+}
+
+// closed reports whether a server's error is from it or its listener
+// having been closed
+func closed(err error) bool {
+	return errors.Is(err, http.ErrServerClosed) ||
+		errors.Is(err, grpc.ErrServerStopped) ||
+		errors.Is(err, cmux.ErrListenerClosed) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// Errors receives the errors the servers fail with while serving. The
+// agent should be shut down once one is received.
+func (a *Agent) Errors() <-chan error {
+	return a.errs
+}
+
+// Done is closed once Shutdown has been called.
+func (a *Agent) Done() <-chan struct{} {
+	return a.shutdowns
+}
+
+// Shutdown drains the servers, refusing produce requests and ending the
+// record streams once they've caught up, then waits up to ShutdownTimeout
+// for the requests in flight to finish before cutting them off. Finally it
+// flushes and closes the log, so every record acknowledged to a client
+// survives a restart.
+func (a *Agent) Shutdown() error {
+	a.shutdownLock.Lock()
+	defer a.shutdownLock.Unlock()
+	if a.shutdown {
+		return nil
+	}
+	a.shutdown = true
+	close(a.shutdowns)
+
+	timeout := a.ShutdownTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Stop producing and streaming, no longer reporting ready
+	if a.health != nil {
+		a.health.Shutdown()
+	}
+	// Leave the cluster before its log goes away
+	var err error
+	if a.membership != nil {
+		err = a.membership.Leave()
+	}
+	if a.repo != nil {
+		a.repo.Drain()
+	}
+
+	// Stop the servers once their requests finish or time out
+	if a.grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			a.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			a.grpcServer.Stop()
+		}
+	}
+	if a.httpServer != nil {
+		if err := a.httpServer.Shutdown(ctx); err != nil {
+			a.httpServer.Close()
+		}
+	}
+	if a.repo != nil {
+		a.repo.Close()
+	}
+	for _, ln := range []net.Listener{a.grpcLn, a.httpLn} {
+		// Listeners of a failed New were never served
+		if ln != nil {
+			ln.Close()
+		}
+	}
+
+	// Flush and close the log now nothing appends to it
+	if a.log != nil {
+		if cerr := a.log.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	// Serve metrics until the end so the shutdown can be watched
+	if a.metricsServer != nil {
+		a.metricsServer.Close()
+	}
+	if a.metricsLn != nil {
+		a.metricsLn.Close()
+	}
+
+	// Flush the traces of the last requests
+	if a.traces != nil {
+		a.traces.Shutdown(ctx)
+	}
+	if a.traceFile != nil && a.traceFile != os.Stdout {
+		a.traceFile.Close()
+	}
+	return err
+}
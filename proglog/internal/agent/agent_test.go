@@ -0,0 +1,523 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	api "github.com/mstreet3/proglog/api/v1"
+	"github.com/mstreet3/proglog/internal/certtest"
+	"github.com/mstreet3/proglog/internal/config"
+	"github.com/mstreet3/proglog/internal/loadbalance"
+	"github.com/mstreet3/proglog/internal/log"
+)
+
+func TestAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca, err := certtest.NewCA(dir)
+	require.NoError(t, err)
+	serverCert, serverKey, err := ca.Issue("server", true)
+	require.NoError(t, err)
+	clientCert, clientKey, err := ca.Issue("root", false)
+	require.NoError(t, err)
+	dataDir, err := ioutil.TempDir("", "agent-test-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	ports := dynaport.Get(3)
+	a, err := New(Config{
+		DataDir:     dataDir,
+		GRPCAddr:    fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		HTTPAddr:    fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		MetricsAddr: fmt.Sprintf("127.0.0.1:%d", ports[2]),
+		TraceFile:   filepath.Join(dir, "traces.json"),
+		ServerTLSConfig: config.TLSConfig{
+			CertFile: serverCert,
+			KeyFile:  serverKey,
+			CAFile:   ca.File,
+		},
+		ACLModelFile:    "../auth/testdata/model.conf",
+		ACLPolicyFile:   "../auth/testdata/policy.csv",
+		ShutdownTimeout: 5 * time.Second,
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+
+	// Produce over gRPC with a client certificate
+	creds, err := config.DialOption(config.TLSConfig{
+		CertFile:      clientCert,
+		KeyFile:       clientKey,
+		CAFile:        ca.File,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	conn, err := grpc.Dial(a.GRPCAddr, creds)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+	ctx := context.Background()
+	res, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+
+	// Consume over HTTPS from the same log
+	httpTLS, err := config.SetupTLSConfig(config.TLSConfig{
+		CAFile:        ca.File,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: httpTLS}}
+	hres, err := httpClient.Get(
+		fmt.Sprintf("https://%s/v1/topics/default/records/0", a.HTTPAddr),
+	)
+	require.NoError(t, err)
+	hres.Body.Close()
+	require.Equal(t, http.StatusOK, hres.StatusCode)
+
+	// The server reports itself ready to probes and gRPC health checks
+	hres, err = httpClient.Get(fmt.Sprintf("https://%s/readyz", a.HTTPAddr))
+	require.NoError(t, err)
+	hres.Body.Close()
+	require.Equal(t, http.StatusOK, hres.StatusCode)
+	health, err := healthpb.NewHealthClient(conn).Check(
+		ctx,
+		&healthpb.HealthCheckRequest{Service: "log.v1.Log"},
+	)
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, health.Status)
+
+	// Both requests show in the metrics, which need no credentials
+	mres, err := http.Get(fmt.Sprintf("http://%s/metrics", a.MetricsAddr))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(mres.Body)
+	mres.Body.Close()
+	require.NoError(t, err)
+	for _, line := range []string{
+		`proglog_grpc_requests_total{code="OK",method="Produce"} 1`,
+		`proglog_http_requests_total{code="200",method="get"} 1`,
+		`proglog_log_highest_offset{log="default"} 0`,
+	} {
+		require.Contains(t, string(body), line)
+	}
+
+	// Shutting down ends open streams
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	// Connections the client dialed but never used hold up the shutdown
+	httpClient.CloseIdleConnections()
+	require.NoError(t, a.Shutdown())
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// The produce was traced from the server into the log
+	traces, err := ioutil.ReadFile(a.TraceFile)
+	require.NoError(t, err)
+	for _, name := range []string{"log.v1.Log/Produce", "log.Append", "HTTP GET"} {
+		require.Contains(t, string(traces), fmt.Sprintf("%q", name))
+	}
+
+	// The log was closed cleanly with the produced record
+	l, err := log.NewLog(dataDir, log.Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	record, err := l.Read(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+func TestAgentShutdownUnderLoad(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "agent-test-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	logConfig := loadLogConfig()
+
+	ports := dynaport.Get(2)
+	a, err := New(Config{
+		DataDir:         dataDir,
+		Log:             logConfig,
+		GRPCAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		HTTPAddr:        fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		ShutdownTimeout: 5 * time.Second,
+	})
+	require.NoError(t, err)
+	conn, err := grpc.Dial(a.GRPCAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+	ctx := context.Background()
+
+	// Tail the log while it's produced to
+	load := produceLoad(ctx, client)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	load.wg.Add(1)
+	go func() {
+		defer load.wg.Done()
+		for {
+			if _, err := stream.Recv(); err != nil {
+				load.errs <- err
+				return
+			}
+		}
+	}()
+
+	// Shut down mid-load without waiting out the timeout
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	require.NoError(t, a.Shutdown())
+	require.Less(t, int64(time.Since(start)), int64(a.ShutdownTimeout))
+	for _, err := range load.wait() {
+		require.Equal(t, codes.Unavailable, status.Code(err), err)
+	}
+	load.requireAcked(t, dataDir, logConfig)
+}
+
+// agentProcessEnv passes the data directory and addresses of the agent
+// TestAgentProcess runs to the child process
+const agentProcessEnv = "PROGLOG_TEST_AGENT_PROCESS"
+
+// TestAgentProcess runs an agent until the process is killed, when it's
+// run as a child process of TestAgentKilledUnderLoad
+func TestAgentProcess(t *testing.T) {
+	env := os.Getenv(agentProcessEnv)
+	if env == "" {
+		t.Skip("run as a child process")
+	}
+	args := strings.Split(env, ",")
+	_, err := New(Config{
+		DataDir:  args[0],
+		Log:      loadLogConfig(),
+		GRPCAddr: args[1],
+		HTTPAddr: args[2],
+	})
+	require.NoError(t, err)
+	// Give up should the test be gone without killing the process
+	time.Sleep(time.Minute)
+}
+
+func TestAgentKilledUnderLoad(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "agent-test-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	ports := dynaport.Get(2)
+	grpcAddr := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAgentProcess$")
+	cmd.Env = append(os.Environ(), fmt.Sprintf(
+		"%s=%s,%s,127.0.0.1:%d",
+		agentProcessEnv,
+		dataDir,
+		grpcAddr,
+		ports[1],
+	))
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	conn, err := grpc.Dial(grpcAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+	ctx := context.Background()
+	require.Eventually(t, func() bool {
+		_, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Kill the agent mid-load, leaving it no chance to flush the log
+	load := produceLoad(ctx, client)
+	time.Sleep(200 * time.Millisecond)
+	require.NoError(t, cmd.Process.Kill())
+	_ = cmd.Wait()
+	load.wait()
+	load.requireAcked(t, dataDir, loadLogConfig())
+}
+
+// loadLogConfig configures the logs of the agents produced to under load,
+// rolling their segments every few records
+func loadLogConfig() log.Config {
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	return c
+}
+
+// load produces to an agent from streams and unary calls, noting each
+// acknowledged record, until the agent stops serving them
+type load struct {
+	mu    sync.Mutex
+	acked map[uint64]string
+	wg    sync.WaitGroup
+	errs  chan error
+}
+
+func produceLoad(ctx context.Context, client api.LogClient) *load {
+	l := &load{
+		acked: make(map[uint64]string),
+		// Room for every producer's error and a consumer's
+		errs: make(chan error, 9),
+	}
+	for i := 0; i < 4; i++ {
+		l.wg.Add(2)
+		go func(i int) {
+			defer l.wg.Done()
+			for j := 0; ; j++ {
+				value := fmt.Sprintf("stream-%d-%d", i, j)
+				stream, err := client.ProduceStream(ctx, &api.ProduceRequest{
+					Record: &api.Record{Value: []byte(value)},
+				})
+				if err != nil {
+					l.errs <- err
+					return
+				}
+				res, err := stream.Recv()
+				if err != nil {
+					l.errs <- err
+					return
+				}
+				l.ack(res.Offset, value)
+			}
+		}(i)
+		go func(i int) {
+			defer l.wg.Done()
+			for j := 0; ; j++ {
+				value := fmt.Sprintf("unary-%d-%d", i, j)
+				res, err := client.Produce(ctx, &api.ProduceRequest{
+					Record: &api.Record{Value: []byte(value)},
+				})
+				if err != nil {
+					l.errs <- err
+					return
+				}
+				l.ack(res.Offset, value)
+			}
+		}(i)
+	}
+	return l
+}
+
+func (l *load) ack(off uint64, value string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.acked[off] = value
+}
+
+// wait waits for the load to stop and returns the errors that stopped it
+func (l *load) wait() (errs []error) {
+	l.wg.Wait()
+	close(l.errs)
+	for err := range l.errs {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// requireAcked requires every acknowledged record to be in the log in dir
+func (l *load) requireAcked(t *testing.T, dir string, c log.Config) {
+	t.Helper()
+	require.NotEmpty(t, l.acked)
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	for off, value := range l.acked {
+		record, err := clog.Read(context.Background(), off)
+		require.NoError(t, err)
+		require.Equal(t, value, string(record.Value))
+	}
+}
+
+func TestUnreadableDataDir(t *testing.T) {
+	// A file where the data directory should be
+	f, err := ioutil.TempFile("", "agent-test-log")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	defer os.Remove(f.Name())
+
+	ports := dynaport.Get(2)
+	_, err = New(Config{
+		DataDir:  f.Name(),
+		GRPCAddr: fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		HTTPAddr: fmt.Sprintf("127.0.0.1:%d", ports[1]),
+	})
+	require.Error(t, err)
+}
+
+func TestServeErrors(t *testing.T) {
+	a := &Agent{
+		errs:      make(chan error, 4),
+		shutdowns: make(chan struct{}),
+	}
+
+	// Servers closing is no failure
+	a.goServe(func() error { return http.ErrServerClosed })
+	a.goServe(func() error { return grpc.ErrServerStopped })
+	failed := errors.New("failed")
+	a.goServe(func() error { return failed })
+	select {
+	case err := <-a.Errors():
+		require.Equal(t, failed, err)
+	case <-time.After(time.Second):
+		t.Fatal("server error not reported")
+	}
+
+	// Nor is stopping during shutdown
+	close(a.shutdowns)
+	a.goServe(func() error { return failed })
+	select {
+	case err := <-a.Errors():
+		t.Fatalf("unexpected error: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca, err := certtest.NewCA(dir)
+	require.NoError(t, err)
+	serverCert, serverKey, err := ca.Issue("server", true)
+	require.NoError(t, err)
+	clientCert, clientKey, err := ca.Issue("root", false)
+	require.NoError(t, err)
+
+	logConfig := log.Config{}
+	logConfig.Raft.HeartbeatTimeout = 100 * time.Millisecond
+	logConfig.Raft.ElectionTimeout = 100 * time.Millisecond
+	logConfig.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
+	logConfig.Raft.CommitTimeout = 5 * time.Millisecond
+
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(3)
+		dataDir, err := ioutil.TempDir("", "agent-test-log")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].BindAddr)
+		}
+		a, err := New(Config{
+			DataDir:  dataDir,
+			Log:      logConfig,
+			NodeName: fmt.Sprintf("%d", i),
+			BindAddr: fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			GRPCAddr: fmt.Sprintf("127.0.0.1:%d", ports[1]),
+			HTTPAddr: fmt.Sprintf("127.0.0.1:%d", ports[2]),
+			ServerTLSConfig: config.TLSConfig{
+				CertFile: serverCert,
+				KeyFile:  serverKey,
+				CAFile:   ca.File,
+			},
+			// Server certificates are valid for client auth too, so peers
+			// dial each other with them
+			PeerTLSConfig: config.TLSConfig{
+				CertFile: serverCert,
+				KeyFile:  serverKey,
+				CAFile:   ca.File,
+			},
+			ACLModelFile:      "../auth/testdata/model.conf",
+			ACLPolicyFile:     "../auth/testdata/policy.csv",
+			StartJoinAddrs:    startJoinAddrs,
+			Bootstrap:         i == 0,
+			ShutdownTimeout:   5 * time.Second,
+			MinInSyncReplicas: uint64(2 - i),
+		})
+		require.NoError(t, err)
+		defer a.Shutdown()
+		agents = append(agents, a)
+	}
+
+	// The client finds the cluster's servers through any of them
+	creds, err := config.DialOption(config.TLSConfig{
+		CertFile:      clientCert,
+		KeyFile:       clientKey,
+		CAFile:        ca.File,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", loadbalance.Name, agents[1].GRPCAddr),
+		creds,
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+	ctx := context.Background()
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(ctx, &api.GetServersRequest{})
+		return err == nil && len(res.Servers) == 3
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// Produces go to the leader and are read back from the followers
+	produce := func(value string) uint64 {
+		var off uint64
+		require.Eventually(t, func() bool {
+			res, err := client.Produce(ctx, &api.ProduceRequest{
+				Record: &api.Record{Value: []byte(value)},
+			})
+			if err != nil {
+				return false
+			}
+			off = res.Offset
+			return true
+		}, 5*time.Second, 50*time.Millisecond)
+		return off
+	}
+	consume := func(off uint64, value string) {
+		require.Eventually(t, func() bool {
+			res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: off})
+			return err == nil && string(res.Record.Value) == value
+		}, 5*time.Second, 50*time.Millisecond)
+	}
+	// The first record follows the topic config the bootstrapping agent
+	// appended, which the other agents' settings don't change
+	off := produce("first")
+	require.Equal(t, uint64(1), off)
+	consume(off, "first")
+	for _, a := range agents[1:] {
+		require.Eventually(t, func() bool {
+			record, err := a.log.Read(ctx, off)
+			return err == nil && string(record.Value) == "first"
+		}, 3*time.Second, 50*time.Millisecond)
+		require.Equal(t, uint64(2), a.distributed.TopicConfig().MinInsyncReplicas)
+	}
+
+	// Followers forward produces to the leader
+	followerConn, err := grpc.Dial(agents[1].GRPCAddr, creds)
+	require.NoError(t, err)
+	defer followerConn.Close()
+	res, err := api.NewLogClient(followerConn).Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("forwarded")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Offset)
+	consume(res.Offset, "forwarded")
+
+	// The client carries on once the leader is gone
+	require.NoError(t, agents[0].Shutdown())
+	off = produce("second")
+	require.Equal(t, uint64(3), off)
+	consume(off, "second")
+}
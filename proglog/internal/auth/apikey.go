@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Scopes granted to API keys. The admin scope grants every scope.
+const (
+	ScopeProduce = "produce"
+	ScopeConsume = "consume"
+	ScopeAdmin   = "admin"
+)
+
+var ErrInvalidKey = errors.New("invalid api key")
+
+// KeyStore authenticates API keys of the form "<id>.<signature>", where
+// the signature is the hex encoded HMAC-SHA256 of the id under the store's
+// secret. The store only holds the ids and scopes of the keys it accepts,
+// so removing an id revokes its key.
+type KeyStore struct {
+	secret []byte
+	scopes map[string]map[string]bool
+}
+
+// NewKeyStore loads a key store from a CSV file where each line holds a
+// key id followed by the scopes it is granted, e.g. "ingest, produce".
+func NewKeyStore(file string, secret []byte) (*KeyStore, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	ks := &KeyStore{
+		secret: secret,
+		scopes: make(map[string]map[string]bool),
+	}
+	for {
+		fields, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		scopes := make(map[string]bool)
+		for _, scope := range fields[1:] {
+			scopes[scope] = true
+		}
+		ks.scopes[fields[0]] = scopes
+	}
+	return ks, nil
+}
+
+// Sign returns the API key for the key id.
+func (ks *KeyStore) Sign(id string) string {
+	return id + "." + hex.EncodeToString(ks.signature(id))
+}
+
+// Authenticate verifies the API key and returns its key id.
+func (ks *KeyStore) Authenticate(key string) (string, error) {
+	i := strings.LastIndex(key, ".")
+	if i < 0 {
+		return "", ErrInvalidKey
+	}
+	id := key[:i]
+	sig, err := hex.DecodeString(key[i+1:])
+	if err != nil || !hmac.Equal(sig, ks.signature(id)) {
+		return "", ErrInvalidKey
+	}
+	if _, ok := ks.scopes[id]; !ok {
+		return "", ErrInvalidKey
+	}
+	return id, nil
+}
+
+// Allowed reports whether the key id was granted the scope.
+func (ks *KeyStore) Allowed(id, scope string) bool {
+	scopes := ks.scopes[id]
+	return scopes[scope] || scopes[ScopeAdmin]
+}
+
+func (ks *KeyStore) signature(id string) []byte {
+	mac := hmac.New(sha256.New, ks.secret)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
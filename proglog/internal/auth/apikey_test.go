@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyStore(t *testing.T) {
+	ks, err := NewKeyStore("testdata/keys.csv", []byte("secret"))
+	require.NoError(t, err)
+
+	// Signed keys authenticate as their id
+	id, err := ks.Authenticate(ks.Sign("ingest"))
+	require.NoError(t, err)
+	require.Equal(t, "ingest", id)
+
+	// Keys signed with another secret, tampered or unknown keys don't
+	other, err := NewKeyStore("testdata/keys.csv", []byte("other"))
+	require.NoError(t, err)
+	for _, key := range []string{
+		other.Sign("ingest"),
+		ks.Sign("ingest") + "00",
+		"ingest",
+		ks.Sign("unknown"),
+	} {
+		_, err = ks.Authenticate(key)
+		require.Equal(t, ErrInvalidKey, err)
+	}
+
+	// Scopes are per key and admin grants all of them
+	require.True(t, ks.Allowed("ingest", ScopeProduce))
+	require.False(t, ks.Allowed("ingest", ScopeConsume))
+	require.True(t, ks.Allowed("dashboard", ScopeConsume))
+	require.False(t, ks.Allowed("dashboard", ScopeProduce))
+	require.True(t, ks.Allowed("operator", ScopeProduce))
+	require.True(t, ks.Allowed("operator", ScopeConsume))
+}
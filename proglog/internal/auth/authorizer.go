@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/casbin/casbin/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Authorizer decides whether a subject may take an action on an object
+// from a Casbin model and a CSV policy file.
+type Authorizer struct {
+	enforcer *casbin.Enforcer
+}
+
+// New loads the Casbin model and policy files.
+func New(model, policy string) (*Authorizer, error) {
+	enforcer, err := casbin.NewEnforcer(model, policy)
+	if err != nil {
+		return nil, err
+	}
+	return &Authorizer{enforcer: enforcer}, nil
+}
+
+// Authorize returns a codes.PermissionDenied status error unless the policy
+// lets the subject take the action on the object.
+func (a *Authorizer) Authorize(subject, object, action string) error {
+	ok, err := a.enforcer.Enforce(subject, object, action)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		msg := fmt.Sprintf(
+			"%s not permitted to %s to %s",
+			subject,
+			action,
+			object,
+		)
+		return status.New(codes.PermissionDenied, msg).Err()
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthorizer(t *testing.T) {
+	authorizer, err := New("testdata/model.conf", "testdata/policy.csv")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		subject, object, action string
+		allowed                 bool
+	}{
+		{"root", "logs", "produce", true},
+		{"root", "other", "consume", true},
+		{"reader", "logs", "consume", true},
+		{"reader", "logs", "produce", false},
+		{"reader", "other", "consume", false},
+		{"nobody", "logs", "consume", false},
+	} {
+		err := authorizer.Authorize(tc.subject, tc.object, tc.action)
+		if tc.allowed {
+			require.NoError(t, err)
+			continue
+		}
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+	}
+}
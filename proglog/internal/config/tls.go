@@ -0,0 +1,167 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSConfig locates the PEM files used to secure a connection. A server
+// with a CAFile requires clients to present certificates signed by that
+// CA; a client with a CertFile and KeyFile presents that certificate.
+type TLSConfig struct {
+	CertFile      string
+	KeyFile       string
+	CAFile        string
+	ServerAddress string
+	Server        bool
+}
+
+// SetupTLSConfig builds a tls.Config from the files in cfg. The certificate
+// and, on servers, the CA are read again whenever their files change, so
+// rotated certificates take effect on new connections without a restart.
+func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	r := &reloader{cfg: cfg}
+	cert, pool, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers build a fresh config for each handshake
+	if cfg.Server {
+		return &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return r.serverConfig()
+			},
+		}, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		ServerName: cfg.ServerAddress,
+	}
+	if cert != nil {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (
+			*tls.Certificate,
+			error,
+		) {
+			cert, _, err := r.load()
+			return cert, err
+		}
+	}
+	return tlsConfig, nil
+}
+
+// ServerOption returns the gRPC server option serving TLS from cfg.
+func ServerOption(cfg TLSConfig) (grpc.ServerOption, error) {
+	cfg.Server = true
+	tlsConfig, err := SetupTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.Creds(credentials.NewTLS(tlsConfig)), nil
+}
+
+// DialOption returns the gRPC dial option connecting over TLS from cfg.
+func DialOption(cfg TLSConfig) (grpc.DialOption, error) {
+	cfg.Server = false
+	tlsConfig, err := SetupTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), nil
+}
+
+// reloader caches the certificate and CA pool read from a TLSConfig's files
+// and reads them again when a file's modification time changes.
+type reloader struct {
+	mu   sync.Mutex
+	cfg  TLSConfig
+	mods map[string]time.Time
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+func (r *reloader) load() (*tls.Certificate, *x509.CertPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Check whether any of the files changed
+	mods := make(map[string]time.Time)
+	changed := r.mods == nil
+	for _, name := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.CAFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return r.fallback(err)
+		}
+		mods[name] = fi.ModTime()
+		if !fi.ModTime().Equal(r.mods[name]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return r.cert, r.pool, nil
+	}
+
+	// Read the certificate and CA
+	var cert *tls.Certificate
+	if r.cfg.CertFile != "" && r.cfg.KeyFile != "" {
+		c, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+		if err != nil {
+			return r.fallback(err)
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if r.cfg.CAFile != "" {
+		b, err := ioutil.ReadFile(r.cfg.CAFile)
+		if err != nil {
+			return r.fallback(err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return r.fallback(
+				fmt.Errorf("failed to parse root certificate: %q", r.cfg.CAFile),
+			)
+		}
+	}
+	r.mods, r.cert, r.pool = mods, cert, pool
+	return cert, pool, nil
+}
+
+// fallback keeps serving the last good certificate when the files can't be
+// read, e.g. while they are halfway through being replaced
+func (r *reloader) fallback(err error) (*tls.Certificate, *x509.CertPool, error) {
+	if r.mods == nil {
+		return nil, nil, err
+	}
+	return r.cert, r.pool, nil
+}
+
+func (r *reloader) serverConfig() (*tls.Config, error) {
+	cert, pool, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+	if pool != nil {
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mstreet3/proglog/internal/certtest"
+)
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, err := certtest.NewCA(dir)
+	require.NoError(t, err)
+	serverCert, serverKey, err := ca.Issue("server", true)
+	require.NoError(t, err)
+	clientCert, clientKey, err := ca.Issue("client", false)
+	require.NoError(t, err)
+
+	// Serve mutual TLS, echoing one byte per connection
+	serverTLS, err := SetupTLSConfig(TLSConfig{
+		CertFile: serverCert,
+		KeyFile:  serverKey,
+		CAFile:   ca.File,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b := make([]byte, 1)
+			if _, err := conn.Read(b); err == nil {
+				conn.Write(b)
+			}
+			conn.Close()
+		}
+	}()
+
+	// dial connects and returns the server certificate's common name
+	dial := func(cfg TLSConfig) (string, error) {
+		cfg.CAFile = ca.File
+		cfg.ServerAddress = "127.0.0.1"
+		clientTLS, err := SetupTLSConfig(cfg)
+		require.NoError(t, err)
+		conn, err := tls.Dial("tcp", l.Addr().String(), clientTLS)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		if _, err = conn.Write([]byte{1}); err != nil {
+			return "", err
+		}
+		if _, err = conn.Read(make([]byte, 1)); err != nil {
+			return "", err
+		}
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+	}
+	withCert := TLSConfig{CertFile: clientCert, KeyFile: clientKey}
+
+	// Clients must present a certificate
+	name, err := dial(withCert)
+	require.NoError(t, err)
+	require.Equal(t, "server", name)
+	_, err = dial(TLSConfig{})
+	require.Error(t, err)
+
+	// Replacing the server certificate takes effect without a restart
+	rotatedCert, rotatedKey, err := ca.Issue("rotated", true)
+	require.NoError(t, err)
+	require.NoError(t, os.Rename(rotatedCert, serverCert))
+	require.NoError(t, os.Rename(rotatedKey, serverKey))
+	name, err = dial(withCert)
+	require.NoError(t, err)
+	require.Equal(t, "rotated", name)
+
+	// Certificates from another CA are rejected
+	otherDir, err := ioutil.TempDir("", "tls-test-other")
+	require.NoError(t, err)
+	defer os.RemoveAll(otherDir)
+	other, err := certtest.NewCA(otherDir)
+	require.NoError(t, err)
+	otherCert, otherKey, err := other.Issue("client", false)
+	require.NoError(t, err)
+	_, err = dial(TLSConfig{CertFile: otherCert, KeyFile: otherKey})
+	require.Error(t, err)
+}
@@ -0,0 +1,190 @@
+// Package discovery finds the other servers of a cluster by gossip and
+// tells a Handler as they join and leave it.
+package discovery
+
+import (
+	"net"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// RPCAddrTag names the tag members advertise their RPC address in.
+const RPCAddrTag = "rpc_addr"
+
+// Membership is the local member of a cluster. It gossips with the other
+// members and hands their joins and departures to its Handler.
+type Membership struct {
+	Config
+	handler Handler
+	serf    *serf.Serf
+	events  chan serf.Event
+	logger  *zap.Logger
+}
+
+// New starts the member, joining the cluster through the StartJoinAddrs.
+func New(handler Handler, config Config) (*Membership, error) {
+	logger := config.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	c := &Membership{
+		Config:  config,
+		handler: handler,
+		logger:  logger.Named("membership"),
+	}
+	if err := c.setupSerf(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type Config struct {
+	// NodeName identifies the member in the cluster
+	NodeName string
+	// BindAddr is the address the member gossips on
+	BindAddr string
+	// Tags are shared with the other members, RPCAddrTag among them
+	Tags map[string]string
+	// StartJoinAddrs are the gossip addresses of members already in the
+	// cluster, none when starting a new one
+	StartJoinAddrs []string
+	// Logger logs the membership changes and Serf's own logs at the debug
+	// level, when it's set
+	Logger *zap.Logger
+}
+
+func (m *Membership) setupSerf() (err error) {
+	addr, err := net.ResolveTCPAddr("tcp", m.BindAddr)
+	if err != nil {
+		return err
+	}
+	config := serf.DefaultConfig()
+	config.Init()
+	config.MemberlistConfig.BindAddr = addr.IP.String()
+	config.MemberlistConfig.BindPort = addr.Port
+	m.events = make(chan serf.Event)
+	config.EventCh = m.events
+	config.Tags = m.Tags
+	config.NodeName = m.Config.NodeName
+
+	// Serf and memberlist chatter about every probe
+	serfLog, err := zap.NewStdLogAt(m.logger.Named("serf"), zapcore.DebugLevel)
+	if err != nil {
+		return err
+	}
+	config.LogOutput = serfLog.Writer()
+	config.MemberlistConfig.LogOutput = serfLog.Writer()
+
+	m.serf, err = serf.Create(config)
+	if err != nil {
+		return err
+	}
+	go m.eventHandler()
+	if m.StartJoinAddrs != nil {
+		_, err = m.serf.Join(m.StartJoinAddrs, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler is told of the other members joining and leaving the cluster,
+// e.g. to replicate their logs or add them to a Raft cluster.
+type Handler interface {
+	Join(name, addr string) error
+	Leave(name string) error
+}
+
+// eventHandler hands the membership changes of the other members to the
+// handler until Serf shuts down. Members that failed are left just like
+// those that left gracefully.
+func (m *Membership) eventHandler() {
+	for {
+		var e serf.Event
+		select {
+		case e = <-m.events:
+		case <-m.serf.ShutdownCh():
+			return
+		}
+		switch e.EventType() {
+		case serf.EventMemberJoin:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleJoin(member)
+			}
+		case serf.EventMemberLeave, serf.EventMemberFailed:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					// Serf still sends events until it shuts down
+					continue
+				}
+				m.handleLeave(member)
+			}
+		}
+	}
+}
+
+func (m *Membership) handleJoin(member serf.Member) {
+	if err := m.handler.Join(
+		member.Name,
+		member.Tags[RPCAddrTag],
+	); err != nil {
+		m.logError(err, "failed to join", member)
+		return
+	}
+	m.logger.Info("member joined", memberFields(member)...)
+}
+
+func (m *Membership) handleLeave(member serf.Member) {
+	if err := m.handler.Leave(
+		member.Name,
+	); err != nil {
+		m.logError(err, "failed to leave", member)
+		return
+	}
+	m.logger.Info("member left",
+		append(memberFields(member), zap.Stringer("status", member.Status))...,
+	)
+}
+
+func (m *Membership) isLocal(member serf.Member) bool {
+	return m.serf.LocalMember().Name == member.Name
+}
+
+// Members returns a point-in-time snapshot of the cluster's members.
+func (m *Membership) Members() []serf.Member {
+	return m.serf.Members()
+}
+
+// Leave tells the other members this one is leaving the cluster, then
+// stops gossiping with them.
+func (m *Membership) Leave() error {
+	if err := m.serf.Leave(); err != nil {
+		return err
+	}
+	return m.serf.Shutdown()
+}
+
+// logError logs the handler's failure to handle a member. Only the leader
+// of a Raft cluster can change it, so the other members' ErrNotLeader are
+// expected and logged at the debug level.
+func (m *Membership) logError(err error, msg string, member serf.Member) {
+	log := m.logger.Error
+	if err == raft.ErrNotLeader {
+		log = m.logger.Debug
+	}
+	log(msg, append(memberFields(member), zap.Error(err))...)
+}
+
+func memberFields(member serf.Member) []zap.Field {
+	return []zap.Field{
+		zap.String("name", member.Name),
+		zap.String(RPCAddrTag, member.Tags[RPCAddrTag]),
+	}
+}
@@ -0,0 +1,115 @@
+package discovery
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+func TestMembership(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			len(handler.leaves) == 0
+	}, 3*time.Second, 250*time.Millisecond)
+	joined := map[string]string{}
+	for i := 0; i < 2; i++ {
+		j := <-handler.joins
+		joined[j["id"]] = j["addr"]
+	}
+	require.Equal(t, map[string]string{
+		"1": m[1].Tags[RPCAddrTag],
+		"2": m[2].Tags[RPCAddrTag],
+	}, joined)
+
+	// A member leaving gracefully is left at once
+	require.NoError(t, m[2].Leave())
+	require.Equal(t, serf.SerfShutdown, m[2].serf.State())
+	require.Eventually(t, func() bool {
+		return len(handler.leaves) == 1 &&
+			memberStatus(m[0], "2") == serf.StatusLeft
+	}, 3*time.Second, 250*time.Millisecond)
+	require.Equal(t, "2", <-handler.leaves)
+
+	// A member that stops answering is left once it's found to have failed
+	require.NoError(t, m[1].serf.Shutdown())
+	require.Eventually(t, func() bool {
+		return len(handler.leaves) == 1 &&
+			memberStatus(m[0], "1") == serf.StatusFailed
+	}, 10*time.Second, 250*time.Millisecond)
+	require.Equal(t, "1", <-handler.leaves)
+}
+
+func setupMember(t *testing.T, members []*Membership) (
+	[]*Membership, *handler,
+) {
+	id := len(members)
+	ports := dynaport.Get(1)
+	addr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+	tags := map[string]string{
+		RPCAddrTag: addr,
+	}
+	c := Config{
+		NodeName: fmt.Sprintf("%d", id),
+		BindAddr: addr,
+		Tags:     tags,
+	}
+	h := &handler{}
+	if len(members) == 0 {
+		h.joins = make(chan map[string]string, 3)
+		h.leaves = make(chan string, 3)
+	} else {
+		c.StartJoinAddrs = []string{
+			members[0].BindAddr,
+		}
+	}
+	m, err := New(h, c)
+	require.NoError(t, err)
+	// Stop the members that haven't left by the end of the test
+	t.Cleanup(func() {
+		if m.serf.State() != serf.SerfShutdown {
+			_ = m.serf.Shutdown()
+		}
+	})
+	members = append(members, m)
+	return members, h
+}
+
+func memberStatus(m *Membership, name string) serf.MemberStatus {
+	for _, member := range m.Members() {
+		if member.Name == name {
+			return member.Status
+		}
+	}
+	return serf.StatusNone
+}
+
+type handler struct {
+	joins  chan map[string]string
+	leaves chan string
+}
+
+func (h *handler) Join(id, addr string) error {
+	if h.joins != nil {
+		h.joins <- map[string]string{
+			"id":   id,
+			"addr": addr,
+		}
+	}
+	return nil
+}
+
+func (h *handler) Leave(id string) error {
+	if h.leaves != nil {
+		h.leaves <- id
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package health
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// DiskSpace checks the file system holding dir has at least minFree bytes
+// available, so the log can keep appending.
+func DiskSpace(dir string, minFree uint64) Check {
+	return Check{
+		Name: "disk",
+		Check: func() error {
+			var stat syscall.Statfs_t
+			if err := syscall.Statfs(dir, &stat); err != nil {
+				return err
+			}
+			free := uint64(stat.Bavail) * uint64(stat.Bsize)
+			if free < minFree {
+				return fmt.Errorf(
+					"%d bytes free, below the minimum of %d",
+					free,
+					minFree,
+				)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package health
+
+// DiskSpace checks the file system holding dir has at least minFree bytes
+// available. Free space can't be read on this platform, so it always
+// passes.
+func DiskSpace(dir string, minFree uint64) Check {
+	return Check{
+		Name:  "disk",
+		Check: func() error { return nil },
+	}
+}
@@ -0,0 +1,156 @@
+// Package health reports whether a proglog server is ready to serve, over
+// the standard grpc.health.v1 service for gRPC clients and over /healthz
+// and /readyz for HTTP probes.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Check reports whether one of the server's dependencies is ready,
+// returning why not when it isn't.
+type Check struct {
+	Name  string
+	Check func() error
+}
+
+// Checker runs its checks every interval and whenever a readiness probe
+// asks, serving only while every check passes.
+type Checker struct {
+	checks []Check
+	grpc   *health.Server
+
+	mu        sync.Mutex
+	services  []string
+	shutdown  bool
+	shutdowns chan struct{}
+}
+
+// New creates a Checker and starts running its checks every interval.
+func New(interval time.Duration, checks ...Check) *Checker {
+	c := &Checker{
+		checks:    checks,
+		grpc:      health.NewServer(),
+		services:  []string{""},
+		shutdowns: make(chan struct{}),
+	}
+	c.check()
+	go c.run(interval)
+	return c
+}
+
+// Register serves the grpc.health.v1 service on the server, reporting the
+// health of the server as a whole and of each service registered so far.
+func (c *Checker) Register(s *grpc.Server) {
+	c.mu.Lock()
+	for name := range s.GetServiceInfo() {
+		c.services = append(c.services, name)
+	}
+	c.mu.Unlock()
+	healthpb.RegisterHealthServer(s, c.grpc)
+	c.check()
+}
+
+func (c *Checker) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.check()
+		case <-c.shutdowns:
+			return
+		}
+	}
+}
+
+// check runs every check, updating the gRPC serving status, and returns
+// the failures by the names of their checks
+func (c *Checker) check() map[string]error {
+	failures := make(map[string]error)
+	for _, check := range c.checks {
+		if err := check.Check(); err != nil {
+			failures[check.Name] = err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shutdown {
+		return failures
+	}
+	status := healthpb.HealthCheckResponse_SERVING
+	if len(failures) > 0 {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	for _, service := range c.services {
+		c.grpc.SetServingStatus(service, status)
+	}
+	return failures
+}
+
+// Shutdown stops serving for good, so load balancers stop routing to the
+// server before it drains.
+func (c *Checker) Shutdown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shutdown {
+		return
+	}
+	c.shutdown = true
+	close(c.shutdowns)
+	c.grpc.Shutdown()
+}
+
+// probe is the body of the HTTP probes' responses
+type probe struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Healthz responds 200 OK while the server can handle requests at all.
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, http.StatusOK, probe{Status: "ok"})
+}
+
+// Readyz runs the checks, responding 200 OK when they all pass and 503
+// Service Unavailable with the failures otherwise, or once the server is
+// shutting down.
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	failures := c.check()
+	c.mu.Lock()
+	shutdown := c.shutdown
+	c.mu.Unlock()
+
+	res := probe{Status: "ok", Checks: make(map[string]string)}
+	for _, check := range c.checks {
+		res.Checks[check.Name] = "ok"
+		if err, ok := failures[check.Name]; ok {
+			res.Checks[check.Name] = err.Error()
+		}
+	}
+	switch {
+	case shutdown:
+		res.Status = "shutting down"
+	case len(failures) > 0:
+		res.Status = "unavailable"
+	}
+	code := http.StatusOK
+	if res.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	writeProbe(w, code, res)
+}
+
+func writeProbe(w http.ResponseWriter, code int, res probe) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(res)
+}
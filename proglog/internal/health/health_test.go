@@ -0,0 +1,84 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestChecker(t *testing.T) {
+	var failing atomic.Value
+	failing.Store(false)
+	c := New(time.Hour, Check{
+		Name: "log",
+		Check: func() error {
+			if failing.Load().(bool) {
+				return errors.New("log is closed")
+			}
+			return nil
+		},
+	})
+	defer c.Shutdown()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	gsrv := grpc.NewServer()
+	c.Register(gsrv)
+	go gsrv.Serve(l)
+	defer gsrv.Stop()
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	status := func() healthpb.HealthCheckResponse_ServingStatus {
+		res, err := client.Check(
+			context.Background(),
+			&healthpb.HealthCheckRequest{},
+		)
+		require.NoError(t, err)
+		return res.Status
+	}
+	readyz := func() (int, probe) {
+		w := httptest.NewRecorder()
+		c.Readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		var res probe
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		return w.Code, res
+	}
+
+	// Serving while the checks pass
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, status())
+	code, res := readyz()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, probe{Status: "ok", Checks: map[string]string{"log": "ok"}}, res)
+
+	// Failing checks stop the server serving
+	failing.Store(true)
+	code, res = readyz()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "log is closed", res.Checks["log"])
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status())
+	failing.Store(false)
+	code, _ = readyz()
+	require.Equal(t, http.StatusOK, code)
+
+	// Shutting down stops serving for good, though the server's alive
+	c.Shutdown()
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status())
+	code, res = readyz()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "shutting down", res.Status)
+	w := httptest.NewRecorder()
+	c.Healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
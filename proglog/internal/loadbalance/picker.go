@@ -0,0 +1,82 @@
+package loadbalance
+
+import (
+	"path"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+func init() {
+	balancer.Register(
+		base.NewBalancerBuilder(Name, &pickerBuilder{}, base.Config{}),
+	)
+}
+
+// writes are the methods only the leader can serve
+var writes = map[string]bool{
+	"Produce":       true,
+	"ProduceStream": true,
+	"BeginTxn":      true,
+	"AddToTxn":      true,
+	"CommitTxn":     true,
+	"AbortTxn":      true,
+	// Only the leader can change the cluster
+	"AddServer":          true,
+	"PromoteServer":      true,
+	"DemoteServer":       true,
+	"RemoveServer":       true,
+	"TransferLeadership": true,
+}
+
+var _ base.PickerBuilder = (*pickerBuilder)(nil)
+
+type pickerBuilder struct{}
+
+func (b *pickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	p := &Picker{}
+	for sc, scInfo := range buildInfo.ReadySCs {
+		if isLeader(scInfo.Address) {
+			p.leader = sc
+			continue
+		}
+		p.followers = append(p.followers, sc)
+	}
+	return p
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+// Picker sends writes to the leader and spreads reads across the
+// followers in turn. Reads go to the leader when there are no followers,
+// and may see a follower's log a little behind the leader's.
+type Picker struct {
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	current   uint64
+}
+
+func (p *Picker) Pick(info balancer.PickInfo) (
+	balancer.PickResult,
+	error,
+) {
+	var result balancer.PickResult
+	if writes[path.Base(info.FullMethodName)] || len(p.followers) == 0 {
+		result.SubConn = p.leader
+	} else {
+		result.SubConn = p.nextFollower()
+	}
+	if result.SubConn == nil {
+		// Wait for a picker with a leader
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+func (p *Picker) nextFollower() balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, uint64(1))
+	len := uint64(len(p.followers))
+	idx := int(cur % len)
+	return p.followers[idx]
+}
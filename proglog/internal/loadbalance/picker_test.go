@@ -0,0 +1,101 @@
+package loadbalance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestPicker(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		picker balancer.Picker,
+		subConns []*subConn,
+	){
+		"writes go to the leader":           testPickWrites,
+		"reads spread across the followers": testPickReads,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			picker, subConns := setupPicker(true, false, false)
+			fn(t, picker, subConns)
+		})
+	}
+
+	t.Run("reads fall back on the leader", func(t *testing.T) {
+		picker, subConns := setupPicker(true)
+		result, err := picker.Pick(balancer.PickInfo{
+			FullMethodName: "/log.v1.Log/Consume",
+		})
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], result.SubConn)
+	})
+
+	t.Run("no leader to pick", func(t *testing.T) {
+		picker, _ := setupPicker(false, false)
+		_, err := picker.Pick(balancer.PickInfo{
+			FullMethodName: "/log.v1.Log/Produce",
+		})
+		require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+	})
+}
+
+func testPickWrites(t *testing.T, picker balancer.Picker, subConns []*subConn) {
+	for _, method := range []string{"Produce", "ProduceStream", "CommitTxn"} {
+		info := balancer.PickInfo{FullMethodName: "/log.v1.Log/" + method}
+		for i := 0; i < 3; i++ {
+			result, err := picker.Pick(info)
+			require.NoError(t, err)
+			require.Equal(t, subConns[0], result.SubConn)
+		}
+	}
+}
+
+func testPickReads(t *testing.T, picker balancer.Picker, subConns []*subConn) {
+	picked := map[balancer.SubConn]int{}
+	for _, method := range []string{"Consume", "ConsumeStream", "Fetch", "GetOffsets"} {
+		info := balancer.PickInfo{FullMethodName: "/log.v1.Log/" + method}
+		result, err := picker.Pick(info)
+		require.NoError(t, err)
+		picked[result.SubConn]++
+	}
+	require.Equal(t, map[balancer.SubConn]int{
+		subConns[1]: 2,
+		subConns[2]: 2,
+	}, picked)
+}
+
+// setupPicker builds a picker over a ready subconn for each server,
+// flagging which of them is the leader
+func setupPicker(leaders ...bool) (balancer.Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for _, leader := range leaders {
+		sc := &subConn{}
+		attrs := followerAttributes
+		if leader {
+			attrs = leaderAttributes
+		}
+		addr := resolver.Address{Attributes: attrs}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := (&pickerBuilder{}).Build(buildInfo)
+	return picker, subConns
+}
+
+// subConn implements balancer.SubConn
+type subConn struct {
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
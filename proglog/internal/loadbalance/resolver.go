@@ -0,0 +1,234 @@
+// Package loadbalance spreads a client's requests across the servers of a
+// cluster. Clients dial "proglog:///" followed by the address of any of
+// its servers; the resolver asks that server for the others and the
+// picker sends writes to the leader and reads to the followers.
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+// Name is the scheme of the resolver and the name of the balancer.
+const Name = "proglog"
+
+var (
+	// refreshInterval is how often the servers are listed again, to catch
+	// the leader changes that didn't break a connection
+	refreshInterval = 10 * time.Second
+	// retryInterval is how often they're listed while there's no leader
+	retryInterval = 100 * time.Millisecond
+	// resolveTimeout bounds each attempt to list the servers
+	resolveTimeout = 5 * time.Second
+)
+
+// leaderKey marks in its attributes whether an address is the leader's.
+// The attributes are shared so that unchanged addresses compare equal and
+// keep their connections.
+type leaderKey struct{}
+
+var (
+	leaderAttributes   = attributes.New(leaderKey{}, true)
+	followerAttributes = attributes.New(leaderKey{}, false)
+)
+
+func isLeader(addr resolver.Address) bool {
+	if addr.Attributes == nil {
+		return false
+	}
+	leader, _ := addr.Attributes.Value(leaderKey{}).(bool)
+	return leader
+}
+
+func init() {
+	resolver.Register(&builder{})
+}
+
+var _ resolver.Builder = (*builder)(nil)
+
+type builder struct{}
+
+func (b *builder) Build(
+	target resolver.Target,
+	cc resolver.ClientConn,
+	opts resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	r := &Resolver{
+		target:     target.Endpoint,
+		clientConn: cc,
+		logger:     zap.L().Named("resolver"),
+		done:       make(chan struct{}),
+	}
+	// List the servers over the same kind of connection as the client's
+	if opts.DialCreds != nil {
+		r.dialOpts = append(
+			r.dialOpts,
+			grpc.WithTransportCredentials(opts.DialCreds),
+		)
+	} else {
+		r.dialOpts = append(r.dialOpts, grpc.WithInsecure())
+	}
+	if opts.Dialer != nil {
+		r.dialOpts = append(r.dialOpts, grpc.WithContextDialer(opts.Dialer))
+	}
+	r.serviceConfig = cc.ParseServiceConfig(
+		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+	)
+	var err error
+	r.resolverConn, err = grpc.Dial(r.target, r.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	go r.refresh()
+	return r, nil
+}
+
+func (b *builder) Scheme() string {
+	return Name
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+// Resolver resolves a cluster's servers by asking one of them.
+type Resolver struct {
+	mu            sync.Mutex
+	target        string
+	dialOpts      []grpc.DialOption
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	logger        *zap.Logger
+	// servers are the addresses last resolved
+	servers   []string
+	hasLeader bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ResolveNow lists the servers and updates the client with them. It asks
+// the server the client dialed, falling back on the others last resolved
+// when it can't be reached. A server that isn't clustered serves every
+// request itself.
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+	servers, err := r.getServers()
+	var addrs []resolver.Address
+	switch status.Code(err) {
+	case codes.OK:
+		for _, server := range servers {
+			attrs := followerAttributes
+			if server.IsLeader {
+				attrs = leaderAttributes
+			}
+			addrs = append(addrs, resolver.Address{
+				Addr:       server.RpcAddr,
+				Attributes: attrs,
+			})
+		}
+	case codes.FailedPrecondition, codes.Unimplemented:
+		addrs = []resolver.Address{{
+			Addr:       r.target,
+			Attributes: leaderAttributes,
+		}}
+	default:
+		r.logger.Error("failed to resolve servers", zap.Error(err))
+		r.clientConn.ReportError(err)
+		return
+	}
+	r.servers = r.servers[:0]
+	r.hasLeader = false
+	for _, addr := range addrs {
+		r.servers = append(r.servers, addr.Addr)
+		r.hasLeader = r.hasLeader || isLeader(addr)
+	}
+	r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	})
+}
+
+// getServers lists the servers from the first that answers
+func (r *Resolver) getServers() ([]*api.Server, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	res, err := api.NewLogClient(r.resolverConn).GetServers(
+		ctx,
+		&api.GetServersRequest{},
+	)
+	if status.Code(err) != codes.Unavailable {
+		return res.GetServers(), err
+	}
+	for _, addr := range r.servers {
+		if addr == r.target {
+			continue
+		}
+		servers, serr := r.getServersFrom(ctx, addr)
+		if serr == nil {
+			return servers, nil
+		}
+	}
+	return nil, err
+}
+
+func (r *Resolver) getServersFrom(ctx context.Context, addr string) (
+	[]*api.Server,
+	error,
+) {
+	cc, err := grpc.DialContext(ctx, addr, r.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cc.Close()
+	res, err := api.NewLogClient(cc).GetServers(ctx, &api.GetServersRequest{})
+	return res.GetServers(), err
+}
+
+// refresh lists the servers every refreshInterval, or retryInterval while
+// the cluster has no leader, until the resolver is closed
+func (r *Resolver) refresh() {
+	for {
+		r.mu.Lock()
+		interval := refreshInterval
+		if !r.hasLeader {
+			interval = retryInterval
+		}
+		r.mu.Unlock()
+		select {
+		case <-r.done:
+			return
+		case <-time.After(interval):
+		}
+		r.ResolveNow(resolver.ResolveNowOptions{})
+	}
+}
+
+// Close stops resolving and closes the connection to the server.
+func (r *Resolver) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Error("failed to close conn", zap.Error(err))
+	}
+}
@@ -0,0 +1,159 @@
+package loadbalance
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	api "github.com/mstreet3/proglog/api/v1"
+	"github.com/mstreet3/proglog/internal/log"
+	"github.com/mstreet3/proglog/internal/server"
+)
+
+func TestResolver(t *testing.T) {
+	servers := &getServers{servers: []*api.Server{{
+		Id:       "leader",
+		RpcAddr:  "localhost:9001",
+		IsLeader: true,
+	}, {
+		Id:      "follower",
+		RpcAddr: "localhost:9002",
+	}}}
+	addr := setupServer(t, servers)
+
+	conn := &clientConn{}
+	r, err := (&builder{}).Build(
+		resolver.Target{Endpoint: addr},
+		conn,
+		resolver.BuildOptions{},
+	)
+	require.NoError(t, err)
+	defer r.Close()
+	require.Equal(t, []resolver.Address{{
+		Addr:       "localhost:9001",
+		Attributes: leaderAttributes,
+	}, {
+		Addr:       "localhost:9002",
+		Attributes: followerAttributes,
+	}}, conn.state().Addresses)
+
+	// A new leader is picked up once the servers are resolved again
+	servers.set([]*api.Server{{
+		Id:      "leader",
+		RpcAddr: "localhost:9001",
+	}, {
+		Id:       "follower",
+		RpcAddr:  "localhost:9002",
+		IsLeader: true,
+	}})
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Equal(t, []resolver.Address{{
+		Addr:       "localhost:9001",
+		Attributes: followerAttributes,
+	}, {
+		Addr:       "localhost:9002",
+		Attributes: leaderAttributes,
+	}}, conn.state().Addresses)
+}
+
+func TestResolverNotClustered(t *testing.T) {
+	addr := setupServer(t, nil)
+	conn := &clientConn{}
+	r, err := (&builder{}).Build(
+		resolver.Target{Endpoint: addr},
+		conn,
+		resolver.BuildOptions{},
+	)
+	require.NoError(t, err)
+	defer r.Close()
+
+	// The server dialed serves every request
+	require.Equal(t, []resolver.Address{{
+		Addr:       addr,
+		Attributes: leaderAttributes,
+	}}, conn.state().Addresses)
+}
+
+// setupServer serves a log whose cluster's servers are listed by
+// servers, returning the server's address
+func setupServer(t *testing.T, servers server.GetServerer) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "resolver-test")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = clog.Close()
+	})
+	repo := &server.LogRepository{CommitLog: clog}
+	if servers != nil {
+		repo.GetServerer = servers
+	}
+	srv, err := server.NewGRPCServer(repo)
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	t.Cleanup(srv.Stop)
+	return ln.Addr().String()
+}
+
+type getServers struct {
+	mu      sync.Mutex
+	servers []*api.Server
+}
+
+func (s *getServers) GetServers() ([]*api.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.servers, nil
+}
+
+func (s *getServers) set(servers []*api.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers = servers
+}
+
+var _ resolver.ClientConn = (*clientConn)(nil)
+
+// clientConn records the state the resolver updates it with
+type clientConn struct {
+	mu   sync.Mutex
+	last resolver.State
+}
+
+func (c *clientConn) UpdateState(state resolver.State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = state
+}
+
+func (c *clientConn) ReportError(err error) {}
+
+func (c *clientConn) NewAddress(addrs []resolver.Address) {}
+
+func (c *clientConn) NewServiceConfig(config string) {}
+
+func (c *clientConn) ParseServiceConfig(
+	config string,
+) *serviceconfig.ParseResult {
+	return nil
+}
+
+func (c *clientConn) state() resolver.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
@@ -1,9 +1,32 @@
 package log
 
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
 type Config struct {
+	// Raft configures a DistributedLog's node
+	Raft struct {
+		raft.Config
+		StreamLayer *StreamLayer
+		// Bootstrap starts a new cluster of this one node
+		Bootstrap bool
+		// ReplicaLagTimeout is how long a follower may go without catching
+		// up with the leader before it's no longer in sync, ten seconds
+		// when zero
+		ReplicaLagTimeout time.Duration
+	}
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// MaxRecordBytes limits the encoded size of appended records,
+		// zero meaning no limit
+		MaxRecordBytes uint64
 	}
+	// OnSync, when set, is called with how long each sync of a segment
+	// to disk took
+	OnSync func(time.Duration)
 }
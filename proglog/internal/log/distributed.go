@@ -0,0 +1,1020 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+// ErrNoLeader is returned by Ready while the node doesn't know its
+// cluster's leader.
+var ErrNoLeader = errors.New("no known raft leader")
+
+// ErrBehindLeader is returned by CaughtUp while the node is lagging behind
+// the entries its leader has committed.
+var ErrBehindLeader = errors.New("behind the raft leader")
+
+// DistributedLog is a log replicated across a cluster with Raft. Appends go
+// through the leader, which commits them to a quorum of the cluster before
+// each node applies them to its own log; reads are served from the local
+// log.
+type DistributedLog struct {
+	config    Config
+	log       *Log
+	raftLog   *logStore
+	stable    *raftboltdb.BoltStore
+	transport *replicaTransport
+	raft      *raft.Raft
+}
+
+func NewDistributedLog(dataDir string, config Config) (
+	*DistributedLog,
+	error,
+) {
+	l := &DistributedLog{
+		config: config,
+	}
+	if err := l.setupLog(dataDir); err != nil {
+		return nil, err
+	}
+	if err := l.setupRaft(dataDir); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// setupLog creates the log the replicated records are applied to
+func (l *DistributedLog) setupLog(dataDir string) error {
+	logDir := filepath.Join(dataDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	var err error
+	l.log, err = NewLog(logDir, l.config)
+	return err
+}
+
+// setupRaft creates the node's Raft instance, bootstrapping the cluster
+// when the config asks for it and the node has no state yet
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	fsm := &fsm{log: l.log}
+
+	// Raft's log is a Log too, starting at Raft's first index
+	logDir := filepath.Join(dataDir, "raft", "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	logConfig := l.config
+	logConfig.Segment.InitialOffset = 1
+	// The entries wrap records the data log already limits
+	logConfig.Segment.MaxRecordBytes = 0
+	logConfig.OnSync = nil
+	var err error
+	l.raftLog, err = newLogStore(logDir, logConfig)
+	if err != nil {
+		return err
+	}
+
+	l.stable, err = raftboltdb.NewBoltStore(
+		filepath.Join(dataDir, "raft", "stable"),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Raft logs to its config's LogOutput, or stderr
+	var logOutput io.Writer = os.Stderr
+	if l.config.Raft.LogOutput != nil {
+		logOutput = l.config.Raft.LogOutput
+	}
+
+	retain := 1
+	snapshotStore, err := raft.NewFileSnapshotStore(
+		filepath.Join(dataDir, "raft"),
+		retain,
+		logOutput,
+	)
+	if err != nil {
+		return err
+	}
+
+	maxPool := 5
+	timeout := 10 * time.Second
+	l.transport = newReplicaTransport(
+		raft.NewNetworkTransport(
+			l.config.Raft.StreamLayer,
+			maxPool,
+			timeout,
+			logOutput,
+		),
+		l.raftLog.LastIndex,
+		l.config.Raft.ReplicaLagTimeout,
+	)
+
+	config := raft.DefaultConfig()
+	config.LocalID = l.config.Raft.LocalID
+	config.LogOutput = logOutput
+	if l.config.Raft.LogLevel != "" {
+		config.LogLevel = l.config.Raft.LogLevel
+	}
+	if l.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	}
+	if l.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	}
+	if l.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	}
+	if l.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = l.config.Raft.CommitTimeout
+	}
+	if l.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = l.config.Raft.SnapshotThreshold
+	}
+
+	l.raft, err = raft.NewRaft(
+		config,
+		fsm,
+		l.raftLog,
+		l.stable,
+		snapshotStore,
+		l.transport,
+	)
+	if err != nil {
+		return err
+	}
+	hasState, err := raft.HasExistingState(
+		l.raftLog,
+		l.stable,
+		snapshotStore,
+	)
+	if err != nil {
+		return err
+	}
+	if l.config.Raft.Bootstrap && !hasState {
+		config := raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: l.transport.LocalAddr(),
+			}},
+		}
+		err = l.raft.BootstrapCluster(config).Error()
+	}
+	return err
+}
+
+// Append replicates the record through Raft and returns its offset once a
+// quorum has committed it and the leader has applied it. Only the leader
+// can append; other nodes return raft.ErrNotLeader.
+func (l *DistributedLog) Append(ctx context.Context, record *api.Record) (
+	uint64,
+	error,
+) {
+	return l.AppendAcks(ctx, record, api.Acks_LEADER)
+}
+
+// AppendAcks replicates the record through Raft, returning once it's
+// acknowledged as acks asks. With api.Acks_ALL it refuses the record with
+// api.ErrNotEnoughReplicas unless the topic's min_insync_replicas are in
+// sync, then waits for all of those in sync to have it.
+func (l *DistributedLog) AppendAcks(
+	ctx context.Context,
+	record *api.Record,
+	acks api.Acks,
+) (off uint64, err error) {
+	_, span := tracer.Start(ctx, "raft.Apply")
+	defer func() {
+		endSpan(span, err,
+			attribute.Int64("offset", int64(off)),
+			attribute.String("acks", acks.String()),
+		)
+	}()
+	if acks == api.Acks_ALL {
+		if !l.IsLeader() {
+			return 0, raft.ErrNotLeader
+		}
+		isr, err := l.inSyncReplicas(time.Now())
+		if err != nil {
+			return 0, err
+		}
+		min := l.log.TopicConfig().MinInsyncReplicas
+		if uint64(len(isr)) < min {
+			return 0, api.ErrNotEnoughReplicas{
+				InSync: uint64(len(isr)),
+				Min:    min,
+			}
+		}
+	}
+	// Stamp the record here so every replica keeps the same append time
+	if record.AppendTime == nil {
+		record.AppendTime = timestamppb.Now()
+	}
+	future, err := l.applyFuture(
+		AppendRequestType,
+		&api.ProduceRequest{Record: record},
+	)
+	if err != nil {
+		return 0, err
+	}
+	res, err := response(future)
+	if err != nil {
+		return 0, err
+	}
+	if acks == api.Acks_ALL {
+		if err = l.waitForReplicas(ctx, future.Index()); err != nil {
+			return 0, err
+		}
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+// TopicConfig returns the settings of the log's topic.
+func (l *DistributedLog) TopicConfig() *api.TopicConfig {
+	return l.log.TopicConfig()
+}
+
+// ConfigureTopic replicates the topic's settings to every server through
+// Raft, unless the topic already has them. Only the leader can configure
+// the topic.
+func (l *DistributedLog) ConfigureTopic(
+	ctx context.Context,
+	c *api.TopicConfig,
+) error {
+	if err := validateTopicConfig(c); err != nil {
+		return err
+	}
+	if proto.Equal(c, l.log.TopicConfig()) {
+		return nil
+	}
+	value, err := proto.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = l.Append(ctx, &api.Record{
+		Value:   value,
+		Control: api.Record_TOPIC_CONFIG,
+	})
+	return err
+}
+
+// AppendTxn replicates the records added to a transaction through Raft as
+// one entry, so every node appends all of them or none, and returns their
+// offsets once the leader has applied it.
+func (l *DistributedLog) AppendTxn(
+	ctx context.Context,
+	id uint64,
+	records []*api.Record,
+) (offs []uint64, err error) {
+	_, span := tracer.Start(ctx, "raft.Apply")
+	defer func() {
+		endSpan(span, err,
+			attribute.Int64("transaction_id", int64(id)),
+			attribute.Int("records", len(records)),
+		)
+	}()
+	now := timestamppb.Now()
+	for _, record := range records {
+		if record.AppendTime == nil {
+			record.AppendTime = now
+		}
+	}
+	future, err := l.applyFuture(
+		AppendTxnRequestType,
+		&api.AddToTxnRequest{TransactionId: id, Records: records},
+	)
+	if err != nil {
+		return nil, err
+	}
+	res, err := response(future)
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.AddToTxnResponse).Offsets, nil
+}
+
+// applyFuture encodes the request as a Raft log entry, its first byte being
+// the request's type, and hands it to Raft without waiting for the FSM to
+// apply it
+func (l *DistributedLog) applyFuture(reqType RequestType, req proto.Message) (
+	raft.ApplyFuture,
+	error,
+) {
+	var buf bytes.Buffer
+	_, err := buf.Write([]byte{byte(reqType)})
+	if err != nil {
+		return nil, err
+	}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	_, err = buf.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	timeout := 10 * time.Second
+	return l.raft.Apply(buf.Bytes(), timeout), nil
+}
+
+// response waits for the FSM to apply the entry and returns its response,
+// or the error it responded with
+func response(future raft.ApplyFuture) (interface{}, error) {
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+// inSyncReplicas returns the progress of the servers in sync with this
+// leader as of now, itself included
+func (l *DistributedLog) inSyncReplicas(now time.Time) (
+	map[raft.ServerID]replica,
+	error,
+) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	last, err := l.raftLog.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+	isr := make(map[raft.ServerID]replica)
+	for _, server := range future.Configuration().Servers {
+		if server.ID == l.config.Raft.LocalID {
+			isr[server.ID] = replica{match: last, caughtUp: now}
+			continue
+		}
+		if r, ok := l.transport.inSync(server.ID, now); ok {
+			isr[server.ID] = r
+		}
+	}
+	return isr, nil
+}
+
+// waitForReplicas waits until every replica in sync has the entry at
+// index. Replicas that fall out of sync meanwhile no longer count.
+func (l *DistributedLog) waitForReplicas(
+	ctx context.Context,
+	index uint64,
+) error {
+	for {
+		changed := l.transport.wait()
+		now := time.Now()
+		isr, err := l.inSyncReplicas(now)
+		if err != nil {
+			return err
+		}
+		// Wait for the lagging replicas until they'd drop out of sync
+		var wait time.Duration
+		lagging := false
+		for _, r := range isr {
+			if r.match >= index {
+				continue
+			}
+			drop := r.caughtUp.Add(l.transport.lagTimeout).Sub(now)
+			if !lagging || drop < wait {
+				wait = drop
+			}
+			lagging = true
+		}
+		if !lagging {
+			return nil
+		}
+		if !l.IsLeader() {
+			return raft.ErrLeadershipLost
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// InSyncReplicas lists the ids of the servers in sync with this leader,
+// itself included. Only the leader tracks them.
+func (l *DistributedLog) InSyncReplicas() ([]string, error) {
+	isr, err := l.inSyncReplicas(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id := range isr {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (l *DistributedLog) Read(ctx context.Context, off uint64) (
+	*api.Record,
+	error,
+) {
+	return l.log.Read(ctx, off)
+}
+
+func (l *DistributedLog) ReadCommitted(ctx context.Context, off uint64) (
+	*api.Record,
+	error,
+) {
+	return l.log.ReadCommitted(ctx, off)
+}
+
+func (l *DistributedLog) ReadBatch(
+	ctx context.Context,
+	off, maxRecords, maxBytes uint64,
+) ([]*api.Record, error) {
+	return l.log.ReadBatch(ctx, off, maxRecords, maxBytes)
+}
+
+func (l *DistributedLog) ReadBatchCommitted(
+	ctx context.Context,
+	off, maxRecords, maxBytes uint64,
+) ([]*api.Record, error) {
+	return l.log.ReadBatchCommitted(ctx, off, maxRecords, maxBytes)
+}
+
+func (l *DistributedLog) CommittedOffset(group string) (uint64, error) {
+	return l.log.CommittedOffset(group)
+}
+
+func (l *DistributedLog) Wait() <-chan struct{} {
+	return l.log.Wait()
+}
+
+func (l *DistributedLog) LowestOffset() (uint64, error) {
+	return l.log.LowestOffset()
+}
+
+func (l *DistributedLog) HighestOffset() (uint64, error) {
+	return l.log.HighestOffset()
+}
+
+func (l *DistributedLog) Stats() Stats {
+	return l.log.Stats()
+}
+
+// Ready returns nil while the log is open and the node knows its cluster's
+// leader.
+func (l *DistributedLog) Ready() error {
+	if err := l.log.Ready(); err != nil {
+		return err
+	}
+	if l.raft.Leader() == "" {
+		return ErrNoLeader
+	}
+	return nil
+}
+
+// CaughtUp returns nil while the node keeps up with its cluster: it leads
+// the cluster, or has applied every entry the leader had committed at some
+// point within the config's ReplicaLagTimeout, so reads from it aren't
+// stale by more than that. Otherwise it returns ErrBehindLeader.
+func (l *DistributedLog) CaughtUp() error {
+	if l.IsLeader() {
+		return nil
+	}
+	return l.transport.caughtUp(l.raft.AppliedIndex(), time.Now())
+}
+
+// IsLeader reports whether this node leads the cluster, and so can append.
+func (l *DistributedLog) IsLeader() bool {
+	return l.raft.State() == raft.Leader
+}
+
+// LeaderAddr returns the address of the cluster's leader, empty while the
+// node doesn't know it.
+func (l *DistributedLog) LeaderAddr() string {
+	return string(l.raft.Leader())
+}
+
+// Join adds the server to the cluster as a voter. It must be called on the
+// leader.
+func (l *DistributedLog) Join(id, addr string) error {
+	return l.AddServer(id, addr, api.Suffrage_VOTER)
+}
+
+// AddServer adds the server to the cluster with the suffrage, replacing any
+// other server with its id or address. A server already in the cluster at
+// the address keeps its suffrage, which PromoteServer and DemoteServer
+// change. It must be called on the leader.
+func (l *DistributedLog) AddServer(
+	id, addr string,
+	suffrage api.Suffrage,
+) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			if srv.ID == serverID && srv.Address == serverAddr {
+				// The server has already joined
+				return nil
+			}
+			// Remove the existing server
+			removeFuture := l.raft.RemoveServer(srv.ID, 0, 0)
+			if err := removeFuture.Error(); err != nil {
+				return err
+			}
+		}
+	}
+	if suffrage == api.Suffrage_NONVOTER {
+		return l.raft.AddNonvoter(serverID, serverAddr, 0, 0).Error()
+	}
+	return l.raft.AddVoter(serverID, serverAddr, 0, 0).Error()
+}
+
+// PromoteServer makes the server a voter. It must be called on the leader.
+func (l *DistributedLog) PromoteServer(id string) error {
+	srv, err := l.server(id)
+	if err != nil {
+		return err
+	}
+	return l.raft.AddVoter(srv.ID, srv.Address, 0, 0).Error()
+}
+
+// DemoteServer makes the server a nonvoter, which keeps replicating the
+// log. It must be called on the leader.
+func (l *DistributedLog) DemoteServer(id string) error {
+	srv, err := l.server(id)
+	if err != nil {
+		return err
+	}
+	return l.raft.DemoteVoter(srv.ID, 0, 0).Error()
+}
+
+// RemoveServer removes the server from the cluster, returning
+// api.ErrServerNotFound unless it's in it. It must be called on the leader.
+func (l *DistributedLog) RemoveServer(id string) error {
+	if _, err := l.server(id); err != nil {
+		return err
+	}
+	return l.Leave(id)
+}
+
+// Leave removes the server from the cluster. It must be called on the
+// leader.
+func (l *DistributedLog) Leave(id string) error {
+	removeFuture := l.raft.RemoveServer(raft.ServerID(id), 0, 0)
+	return removeFuture.Error()
+}
+
+// TransferLeadership hands the leadership to the server with the id, or to
+// the most up to date voter when it's empty, and waits for it to take
+// over. It must be called on the leader.
+func (l *DistributedLog) TransferLeadership(id string) error {
+	if id == "" {
+		return l.raft.LeadershipTransfer().Error()
+	}
+	srv, err := l.server(id)
+	if err != nil {
+		return err
+	}
+	return l.raft.LeadershipTransferToServer(srv.ID, srv.Address).Error()
+}
+
+// server returns the server of the cluster with the id
+func (l *DistributedLog) server(id string) (raft.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return raft.Server{}, err
+	}
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID == raft.ServerID(id) {
+			return srv, nil
+		}
+	}
+	return raft.Server{}, api.ErrServerNotFound{Id: id}
+}
+
+// GetServers lists the servers of the cluster, marking its leader.
+func (l *DistributedLog) GetServers() ([]*api.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	leader := l.raft.Leader()
+	var servers []*api.Server
+	for _, server := range future.Configuration().Servers {
+		suffrage := api.Suffrage_VOTER
+		if server.Suffrage == raft.Nonvoter {
+			suffrage = api.Suffrage_NONVOTER
+		}
+		servers = append(servers, &api.Server{
+			Id:       string(server.ID),
+			RpcAddr:  string(server.Address),
+			IsLeader: leader == server.Address,
+			Suffrage: suffrage,
+		})
+	}
+	return servers, nil
+}
+
+// GetClusterState describes the cluster as this node sees it. Only the
+// leader lists the in-sync replicas.
+func (l *DistributedLog) GetClusterState() (*api.GetClusterStateResponse, error) {
+	servers, err := l.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	stats := l.raft.Stats()
+	state := &api.GetClusterStateResponse{
+		Servers:      servers,
+		ServerId:     string(l.config.Raft.LocalID),
+		LastIndex:    l.raft.LastIndex(),
+		AppliedIndex: l.raft.AppliedIndex(),
+	}
+	for _, server := range servers {
+		if server.IsLeader {
+			state.LeaderId = server.Id
+		}
+	}
+	if state.Term, err = strconv.ParseUint(stats["term"], 10, 64); err != nil {
+		return nil, err
+	}
+	state.CommitIndex, err = strconv.ParseUint(stats["commit_index"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if l.IsLeader() {
+		if state.InSyncReplicas, err = l.InSyncReplicas(); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// WaitForLeader blocks until the cluster has elected a leader or the
+// timeout passes.
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(time.Second / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out waiting for a leader")
+		case <-ticker.C:
+			if l := l.raft.Leader(); l != "" {
+				return nil
+			}
+		}
+	}
+}
+
+// Close shuts down the node's Raft instance and closes its logs.
+func (l *DistributedLog) Close() error {
+	f := l.raft.Shutdown()
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err := l.raftLog.Close(); err != nil {
+		return err
+	}
+	if err := l.stable.Close(); err != nil {
+		return err
+	}
+	return l.log.Close()
+}
+
+// RequestType is the first byte of a Raft log entry, telling the FSM how
+// to decode and apply the rest of it.
+type RequestType uint8
+
+const (
+	AppendRequestType    RequestType = 0
+	AppendTxnRequestType RequestType = 1
+)
+
+var _ raft.FSM = (*fsm)(nil)
+
+// fsm applies the committed Raft log entries to the data log
+type fsm struct {
+	log *Log
+}
+
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	buf := record.Data
+	reqType := RequestType(buf[0])
+	switch reqType {
+	case AppendRequestType:
+		return f.applyAppend(buf[1:])
+	case AppendTxnRequestType:
+		return f.applyAppendTxn(buf[1:])
+	}
+	return nil
+}
+
+// applyAppend appends a produced record, returning its offset or the
+// log's error. Every node applies the same entries in the same order, so
+// their logs fail and deduplicate the same appends.
+func (f *fsm) applyAppend(b []byte) interface{} {
+	var req api.ProduceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	off, err := f.log.Append(context.Background(), req.Record)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceResponse{Offset: off}
+}
+
+// applyAppendTxn appends the records added to a transaction together,
+// returning their offsets or the log's error
+func (f *fsm) applyAppendTxn(b []byte) interface{} {
+	var req api.AddToTxnRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	offs, err := f.log.AppendTxn(
+		context.Background(),
+		req.TransactionId,
+		req.Records,
+	)
+	if err != nil {
+		return err
+	}
+	return &api.AddToTxnResponse{Offsets: offs}
+}
+
+// Snapshot returns a snapshot of the data log's stores up to the last
+// applied entry. Raft persists it while later entries are applied, so the
+// reader stops where the stores end now.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	r := f.log.Reader()
+	return &snapshot{reader: r}, nil
+}
+
+// Restore replaces the data log with the records of a snapshot, leaving it
+// empty if the snapshot is
+func (f *fsm) Restore(r io.ReadCloser) error {
+	b := make([]byte, lenWidth)
+	var buf bytes.Buffer
+	for i := 0; ; i++ {
+		_, err := io.ReadFull(r, b)
+		if err == io.EOF {
+			if i == 0 {
+				return f.log.Reset()
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+		size := int64(enc.Uint64(b))
+		if _, err = io.CopyN(&buf, r, size); err != nil {
+			return err
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
+			return err
+		}
+		if i == 0 {
+			f.log.Config.Segment.InitialOffset = record.Offset
+			if err := f.log.Reset(); err != nil {
+				return err
+			}
+		}
+		// The snapshot may begin after some of its records' producers and
+		// transactions did, so they're restored as they are
+		if _, err = f.log.appendReplica(context.Background(), record); err != nil {
+			return err
+		}
+		buf.Reset()
+	}
+	return nil
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+type snapshot struct {
+	reader io.Reader
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := io.Copy(sink, s.reader); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
+
+var _ raft.LogStore = (*logStore)(nil)
+
+// logStore keeps Raft's log in a Log, each entry's index being its
+// record's offset
+type logStore struct {
+	*Log
+}
+
+func newLogStore(dir string, c Config) (*logStore, error) {
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{log}, nil
+}
+
+func (l *logStore) FirstIndex() (uint64, error) {
+	return l.LowestOffset()
+}
+
+func (l *logStore) LastIndex() (uint64, error) {
+	return l.HighestOffset()
+}
+
+func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	in, err := l.Read(context.Background(), index)
+	if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return err
+	}
+	out.Data = in.Value
+	out.Index = in.Offset
+	out.Type = raft.LogType(in.Type)
+	out.Term = in.Term
+	return nil
+}
+
+func (l *logStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+// StoreLogs appends the entries and syncs them to disk before returning, as
+// Raft counts them as durable once they're stored.
+func (l *logStore) StoreLogs(records []*raft.Log) error {
+	for _, record := range records {
+		if err := l.startAt(record.Index); err != nil {
+			return err
+		}
+		off, err := l.Append(context.Background(), &api.Record{
+			Value: record.Data,
+			Term:  record.Term,
+			Type:  uint32(record.Type),
+		})
+		if err != nil {
+			return err
+		}
+		if off != record.Index {
+			return fmt.Errorf(
+				"raft log entry %d stored at offset %d",
+				record.Index,
+				off,
+			)
+		}
+	}
+	return l.Sync()
+}
+
+// startAt resets an empty log to start at index, as Raft continues after
+// the index of its latest snapshot once the log's been compacted away
+func (l *logStore) startAt(index uint64) error {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	highest, err := l.HighestOffset()
+	if err != nil {
+		return err
+	}
+	if highest+1 != lowest || lowest == index {
+		return nil
+	}
+	l.Config.Segment.InitialOffset = index
+	return l.Reset()
+}
+
+// DeleteRange removes the entries from min to max. Raft deletes either a
+// prefix of its log once it's been snapshotted, or the suffix that
+// conflicts with its leader's log.
+func (l *logStore) DeleteRange(min, max uint64) error {
+	last, err := l.HighestOffset()
+	if err != nil {
+		return err
+	}
+	if max >= last {
+		return l.TruncateFrom(min)
+	}
+	return l.Truncate(max)
+}
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+// StreamLayer carries Raft's RPCs between the nodes, over TLS when it's
+// configured.
+type StreamLayer struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+}
+
+func NewStreamLayer(
+	ln net.Listener,
+	serverTLSConfig,
+	peerTLSConfig *tls.Config,
+) *StreamLayer {
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+	}
+}
+
+// RaftRPC is the first byte of a Raft connection, so Raft can share a port
+// with other services.
+const RaftRPC = 1
+
+func (s *StreamLayer) Dial(
+	addr raft.ServerAddress,
+	timeout time.Duration,
+) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn, err = dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+	// Identify to the mux this is a Raft RPC
+	_, err = conn.Write([]byte{byte(RaftRPC)})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if s.peerTLSConfig != nil {
+		tlsConfig := s.peerTLSConfig
+		if tlsConfig.ServerName == "" {
+			// Verify the peer's certificate against the host dialed
+			host, _, err := net.SplitHostPort(string(addr))
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = host
+		}
+		conn = tls.Client(conn, tlsConfig)
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1)
+	_, err = conn.Read(b)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
+		conn.Close()
+		return nil, fmt.Errorf("not a raft rpc")
+	}
+	if s.serverTLSConfig != nil {
+		return tls.Server(conn, s.serverTLSConfig), nil
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
@@ -0,0 +1,554 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+func TestMultipleNodes(t *testing.T) {
+	ctx := context.Background()
+	nodeCount := 3
+	logs := setupCluster(t, nodeCount, nil)
+
+	// Appends to the leader are replicated to every node
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}
+	for _, record := range records {
+		off, err := logs[0].Append(ctx, record)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return replicated(ctx, logs, off, record)
+		}, 500*time.Millisecond, 50*time.Millisecond)
+	}
+
+	// Records added to a transaction are replicated together
+	off, err := logs[0].Append(ctx, &api.Record{Control: api.Record_BEGIN})
+	require.NoError(t, err)
+	marker, err := logs[0].Read(ctx, off)
+	require.NoError(t, err)
+	txn := []*api.Record{{Value: []byte("in")}, {Value: []byte("txn")}}
+	offs, err := logs[0].AppendTxn(ctx, marker.TransactionId, txn)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 4}, offs)
+	for i, off := range offs {
+		require.Eventually(t, func() bool {
+			return replicated(ctx, logs, off, txn[i])
+		}, 500*time.Millisecond, 50*time.Millisecond)
+	}
+	_, err = logs[0].Append(ctx, &api.Record{
+		TransactionId: marker.TransactionId,
+		Control:       api.Record_COMMIT,
+	})
+	require.NoError(t, err)
+
+	// Every node knows the cluster's servers and its leader
+	for _, l := range logs {
+		servers, err := l.GetServers()
+		require.NoError(t, err)
+		require.Len(t, servers, nodeCount)
+		for i, server := range servers {
+			require.Equal(t, fmt.Sprintf("%d", i), server.Id)
+			require.Equal(t, i == 0, server.IsLeader)
+		}
+	}
+
+	// Followers that applied what the leader committed are caught up
+	for _, l := range logs {
+		require.Eventually(t, func() bool {
+			return l.CaughtUp() == nil
+		}, 500*time.Millisecond, 50*time.Millisecond)
+	}
+
+	// Followers can't append
+	_, err = logs[1].Append(ctx, &api.Record{Value: []byte("follower")})
+	require.Equal(t, raft.ErrNotLeader, err)
+
+	// Once the leader fails the others elect a new one and carry on
+	require.NoError(t, logs[0].Close())
+	followers := logs[1:]
+	var leader *DistributedLog
+	require.Eventually(t, func() bool {
+		for _, l := range followers {
+			if l.raft.State() == raft.Leader {
+				leader = l
+				return true
+			}
+		}
+		return false
+	}, 3*time.Second, 50*time.Millisecond)
+
+	record := &api.Record{Value: []byte("third")}
+	off, err = leader.Append(ctx, record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	require.Eventually(t, func() bool {
+		return replicated(ctx, followers, off, record)
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	// The leader can remove the failed node from the cluster
+	require.NoError(t, leader.Leave("0"))
+	configFuture := leader.raft.GetConfiguration()
+	require.NoError(t, configFuture.Error())
+	require.Len(t, configFuture.Configuration().Servers, 2)
+}
+
+func TestCaughtUp(t *testing.T) {
+	transport := &replicaTransport{
+		lagTimeout:   time.Second,
+		leaderCommit: 5,
+	}
+	now := time.Now()
+
+	// Followers are caught up once they've applied the leader's commits
+	require.NoError(t, transport.caughtUp(5, now))
+	// and stay so while they lag for less than the lag timeout
+	transport.leaderCommit = 8
+	require.NoError(t, transport.caughtUp(6, now.Add(time.Second)))
+	err := transport.caughtUp(7, now.Add(2*time.Second))
+	require.True(t, errors.Is(err, ErrBehindLeader))
+	require.NoError(t, transport.caughtUp(8, now.Add(3*time.Second)))
+}
+
+func TestReplicaPipeline(t *testing.T) {
+	transport := &replicaTransport{
+		lastIndex:  func() (uint64, error) { return 3, nil },
+		lagTimeout: time.Second,
+		replicas:   make(map[raft.ServerID]replica),
+		changed:    make(chan struct{}),
+	}
+	p := newReplicaPipeline(transport, "1", &pipeline{
+		futures: make(chan raft.AppendFuture, 2),
+	})
+	defer p.Close()
+	appendEntries := func(prev, last uint64) {
+		args := &raft.AppendEntriesRequest{PrevLogEntry: prev}
+		for i := prev + 1; i <= last; i++ {
+			args.Entries = append(args.Entries, &raft.Log{Index: i})
+		}
+		_, err := p.AppendEntries(args, &raft.AppendEntriesResponse{Success: true})
+		require.NoError(t, err)
+	}
+
+	// The follower's progress is recorded before Raft sees the response
+	appendEntries(0, 2)
+	require.NoError(t, (<-p.Consumer()).Error())
+	r, inSync := transport.inSync("1", time.Now())
+	require.Equal(t, uint64(2), r.match)
+	require.False(t, inSync)
+
+	// even with appends sent without waiting for the earlier ones
+	appendEntries(2, 3)
+	appendEntries(3, 3)
+	for _, prev := range []uint64{2, 3} {
+		future := <-p.Consumer()
+		require.Equal(t, prev, future.Request().PrevLogEntry)
+	}
+	r, inSync = transport.inSync("1", time.Now())
+	require.Equal(t, uint64(3), r.match)
+	require.True(t, inSync)
+}
+
+// pipeline is a raft.AppendPipeline whose appends succeed as soon as
+// they're sent
+type pipeline struct {
+	futures chan raft.AppendFuture
+}
+
+func (p *pipeline) AppendEntries(
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+) (raft.AppendFuture, error) {
+	future := &appendFuture{req: args, resp: resp}
+	p.futures <- future
+	return future, nil
+}
+
+func (p *pipeline) Consumer() <-chan raft.AppendFuture {
+	return p.futures
+}
+
+func (p *pipeline) Close() error {
+	return nil
+}
+
+type appendFuture struct {
+	req  *raft.AppendEntriesRequest
+	resp *raft.AppendEntriesResponse
+}
+
+func (f *appendFuture) Error() error {
+	return nil
+}
+
+func (f *appendFuture) Start() time.Time {
+	return time.Time{}
+}
+
+func (f *appendFuture) Request() *raft.AppendEntriesRequest {
+	return f.req
+}
+
+func (f *appendFuture) Response() *raft.AppendEntriesResponse {
+	return f.resp
+}
+
+func TestAcks(t *testing.T) {
+	ctx := context.Background()
+	logs := setupCluster(t, 3, func(c *Config) {
+		c.Raft.ReplicaLagTimeout = 200 * time.Millisecond
+	})
+	leader := logs[0]
+
+	// The topic's min_insync_replicas is at least one, and replicated to
+	// every server
+	require.Equal(t, uint64(1), leader.TopicConfig().MinInsyncReplicas)
+	require.Error(t, leader.ConfigureTopic(ctx, &api.TopicConfig{}))
+	topic := &api.TopicConfig{MinInsyncReplicas: 3}
+	require.NoError(t, leader.ConfigureTopic(ctx, topic))
+	for _, l := range logs {
+		require.Eventually(t, func() bool {
+			return proto.Equal(topic, l.TopicConfig())
+		}, 500*time.Millisecond, 10*time.Millisecond)
+	}
+	require.Eventually(t, func() bool {
+		isr, err := leader.InSyncReplicas()
+		return err == nil && len(isr) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	// Appends with all acks return once every replica in sync has them
+	record := &api.Record{Value: []byte("first")}
+	off, err := leader.AppendAcks(ctx, record, api.Acks_ALL)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	for _, l := range logs[1:] {
+		last, err := l.raftLog.LastIndex()
+		require.NoError(t, err)
+		leaderLast, err := leader.raftLog.LastIndex()
+		require.NoError(t, err)
+		require.Equal(t, leaderLast, last)
+	}
+
+	// Appends with the leader's acks return once the leader has them
+	record = &api.Record{Value: []byte("second")}
+	off, err = leader.AppendAcks(ctx, record, api.Acks_LEADER)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.Eventually(t, func() bool {
+		return replicated(ctx, logs, 2, record)
+	}, 500*time.Millisecond, 10*time.Millisecond)
+
+	// A failed follower drops out of sync, leaving too few replicas for
+	// appends with all acks but enough for the leader's
+	require.NoError(t, logs[2].Close())
+	require.Eventually(t, func() bool {
+		isr, err := leader.InSyncReplicas()
+		return err == nil && len(isr) == 2
+	}, time.Second, 10*time.Millisecond)
+	isr, err := leader.InSyncReplicas()
+	require.NoError(t, err)
+	require.Equal(t, []string{"0", "1"}, isr)
+
+	_, err = leader.AppendAcks(ctx, &api.Record{Value: []byte("third")}, api.Acks_ALL)
+	require.Equal(t, api.ErrNotEnoughReplicas{InSync: 2, Min: 3}, err)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	off, err = leader.AppendAcks(ctx, &api.Record{Value: []byte("third")}, api.Acks_LEADER)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// Followers take no appends, whatever the acks
+	for _, acks := range []api.Acks{api.Acks_LEADER, api.Acks_ALL} {
+		_, err = logs[1].AppendAcks(ctx, &api.Record{Value: []byte("fourth")}, acks)
+		require.Equal(t, raft.ErrNotLeader, err)
+	}
+}
+
+func TestClusterAdmin(t *testing.T) {
+	ctx := context.Background()
+	logs := setupCluster(t, 3, nil)
+	leader := logs[0]
+	suffrages := func() map[string]api.Suffrage {
+		servers, err := leader.GetServers()
+		require.NoError(t, err)
+		suffrages := make(map[string]api.Suffrage)
+		for _, server := range servers {
+			suffrages[server.Id] = server.Suffrage
+		}
+		return suffrages
+	}
+	servers, err := leader.GetServers()
+	require.NoError(t, err)
+	addr := servers[2].RpcAddr
+
+	// Demoted servers keep replicating until they're promoted again
+	require.NoError(t, leader.DemoteServer("2"))
+	require.Equal(t, api.Suffrage_NONVOTER, suffrages()["2"])
+	record := &api.Record{Value: []byte("first")}
+	off, err := leader.Append(ctx, record)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return replicated(ctx, logs, off, record)
+	}, 500*time.Millisecond, 10*time.Millisecond)
+	require.NoError(t, leader.PromoteServer("2"))
+	require.Equal(t, api.Suffrage_VOTER, suffrages()["2"])
+
+	// Removed servers can be added back as nonvoters
+	require.NoError(t, leader.RemoveServer("2"))
+	require.NotContains(t, suffrages(), "2")
+	require.NoError(t, leader.AddServer("2", addr, api.Suffrage_NONVOTER))
+	require.Equal(t, api.Suffrage_NONVOTER, suffrages()["2"])
+
+	// Unknown servers can't be changed
+	err = leader.RemoveServer("3")
+	require.Equal(t, api.ErrServerNotFound{Id: "3"}, err)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Leadership moves to the server asked for
+	require.NoError(t, leader.TransferLeadership("1"))
+	require.Eventually(t, func() bool {
+		return logs[1].IsLeader()
+	}, time.Second, 10*time.Millisecond)
+	state, err := logs[1].GetClusterState()
+	require.NoError(t, err)
+	require.Equal(t, "1", state.ServerId)
+	require.Equal(t, "1", state.LeaderId)
+	require.Len(t, state.Servers, 3)
+	require.NotZero(t, state.Term)
+	require.GreaterOrEqual(t, state.LastIndex, state.CommitIndex)
+	require.NotEmpty(t, state.InSyncReplicas)
+}
+
+// setupCluster starts a cluster of nodeCount nodes led by the first, with
+// configure adjusting each node's config when it's set. The nodes are closed
+// once the test is done.
+func TestLogStoreDurable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.InitialOffset = 1
+	c.Segment.MaxStoreBytes = 64
+	store, err := newLogStore(dir, c)
+	require.NoError(t, err)
+	defer store.Close()
+
+	var entries []*raft.Log
+	for i := uint64(1); i <= 5; i++ {
+		entries = append(entries, &raft.Log{
+			Index: i,
+			Term:  1,
+			Type:  raft.LogCommand,
+			Data:  []byte(fmt.Sprintf("entry %d", i)),
+		})
+	}
+	require.NoError(t, store.StoreLogs(entries))
+
+	// The entries are on disk as soon as they're stored, as if the node had
+	// crashed and come back without closing the log
+	reopened, err := newLogStore(dir, c)
+	require.NoError(t, err)
+	defer reopened.Close()
+	last, err := reopened.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), last)
+	for _, want := range entries {
+		got := &raft.Log{}
+		require.NoError(t, reopened.GetLog(want.Index, got))
+		require.Equal(t, want.Data, got.Data)
+		require.Equal(t, want.Term, got.Term)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	newFSM := func(maxStoreBytes uint64) *fsm {
+		dir, err := ioutil.TempDir("", "snapshot-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		c := Config{}
+		c.Segment.MaxStoreBytes = maxStoreBytes
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		t.Cleanup(func() { log.Close() })
+		return &fsm{log: log}
+	}
+	appendValues := func(f *fsm, values ...string) {
+		for _, v := range values {
+			_, err := f.log.Append(ctx, &api.Record{Value: []byte(v)})
+			require.NoError(t, err)
+		}
+	}
+
+	// The snapshot holds the records as of when it was taken
+	leader := newFSM(32)
+	appendValues(leader, "first", "second", "third")
+	snap, err := leader.Snapshot()
+	require.NoError(t, err)
+	appendValues(leader, "fourth")
+	sink := &sink{}
+	require.NoError(t, snap.Persist(sink))
+
+	follower := newFSM(32)
+	appendValues(follower, "stale", "stale", "stale", "stale", "stale")
+	require.NoError(t, follower.Restore(ioutil.NopCloser(&sink.buf)))
+	highest, err := follower.log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+	for off, want := range []string{"first", "second", "third"} {
+		record, err := follower.log.Read(ctx, uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+	}
+
+	// A snapshot may start in the middle of a transaction once the log's
+	// head is truncated, and is restored as it is
+	leader = newFSM(1)
+	_, err = leader.log.Append(ctx, &api.Record{Control: api.Record_BEGIN})
+	require.NoError(t, err)
+	marker, err := leader.log.Read(ctx, 0)
+	require.NoError(t, err)
+	for _, control := range []api.Record_Control{
+		api.Record_DATA,
+		api.Record_DATA,
+		api.Record_COMMIT,
+	} {
+		_, err = leader.log.Append(ctx, &api.Record{
+			Value:         []byte("in txn"),
+			TransactionId: marker.TransactionId,
+			Control:       control,
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, leader.log.Truncate(0))
+	lowest, err := leader.log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), lowest)
+	snap, err = leader.Snapshot()
+	require.NoError(t, err)
+	sink.buf.Reset()
+	require.NoError(t, snap.Persist(sink))
+
+	require.NoError(t, follower.Restore(ioutil.NopCloser(&sink.buf)))
+	records, err := follower.log.ReadBatchCommitted(ctx, 1, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, marker.TransactionId, records[0].TransactionId)
+
+	// Restoring an empty snapshot empties the log
+	require.NoError(t, follower.Restore(ioutil.NopCloser(&bytes.Buffer{})))
+	_, err = follower.log.Read(ctx, 0)
+	require.Error(t, err)
+}
+
+// sink is a raft.SnapshotSink persisting to memory
+type sink struct {
+	buf bytes.Buffer
+}
+
+func (s *sink) Write(p []byte) (int, error) {
+	return s.buf.Write(p)
+}
+
+func (s *sink) Close() error {
+	return nil
+}
+
+func (s *sink) ID() string {
+	return "snapshot"
+}
+
+func (s *sink) Cancel() error {
+	return nil
+}
+
+func setupCluster(t *testing.T, nodeCount int, configure func(*Config)) []*DistributedLog {
+	t.Helper()
+	var logs []*DistributedLog
+	ports := dynaport.Get(nodeCount)
+	t.Cleanup(func() {
+		for _, l := range logs {
+			_ = l.Close()
+		}
+	})
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "distributed-log-test")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = os.RemoveAll(dataDir)
+		})
+
+		ln, err := net.Listen(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", ports[i]),
+		)
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		if configure != nil {
+			configure(&config)
+		}
+
+		if i == 0 {
+			config.Raft.Bootstrap = true
+		}
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+
+		if i != 0 {
+			err = logs[0].Join(
+				fmt.Sprintf("%d", i), ln.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+
+		logs = append(logs, l)
+	}
+	return logs
+}
+
+// replicated reports whether every node has the record at off
+func replicated(
+	ctx context.Context,
+	logs []*DistributedLog,
+	off uint64,
+	want *api.Record,
+) bool {
+	for _, l := range logs {
+		got, err := l.Read(ctx, off)
+		if err != nil {
+			return false
+		}
+		if !bytes.Equal(want.Value, got.Value) || got.Offset != off {
+			return false
+		}
+	}
+	return true
+}
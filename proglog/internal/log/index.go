@@ -87,13 +87,43 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
-func (i *index) Close() error {
+// recover drops the entries an unclean shutdown may have left past the
+// last one written, the file having been grown with zeros. Only the leading
+// entries whose offsets count up from zero and whose positions increase
+// within the store are kept.
+func (i *index) recover(storeSize uint64) {
+	var n, prev uint64
+	for ; (n+1)*entWidth <= i.size; n++ {
+		at := n * entWidth
+		off := enc.Uint32(i.mmap[at : at+offWidth])
+		pos := enc.Uint64(i.mmap[at+offWidth : at+entWidth])
+		if uint64(off) != n || pos >= storeSize || n > 0 && pos <= prev {
+			break
+		}
+		prev = pos
+	}
+	i.size = n * entWidth
+}
+
+// Truncate drops the entries from the nth onward
+func (i *index) Truncate(n uint64) {
+	if n*entWidth < i.size {
+		i.size = n * entWidth
+	}
+}
+
+// Sync writes the index's entries through to disk
+func (i *index) Sync() error {
 	// Sync mem map changes to file
 	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
 		return err
 	}
 	// Sync file changes to disk
-	if err := i.file.Sync(); err != nil {
+	return i.file.Sync()
+}
+
+func (i *index) Close() error {
+	if err := i.Sync(); err != nil {
 		return err
 	}
 	// Shrink file back to size
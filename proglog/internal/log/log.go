@@ -1,7 +1,9 @@
 package log
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -10,16 +12,34 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/mstreet3/proglog/api/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
 )
 
+// tracer starts the log's spans from the global tracer provider, so they
+// are only recorded once one is configured
+var tracer = otel.Tracer("github.com/mstreet3/proglog/internal/log")
+
 type Log struct {
 	mu            sync.RWMutex
 	Dir           string
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	appended      chan struct{}
+	producers     producers
+	txns          *transactions
+	// topic is the config of the last TOPIC_CONFIG marker, if any
+	topic  *api.TopicConfig
+	closed bool
+	// appendedBytes counts the bytes appended since the log was opened
+	appendedBytes uint64
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -30,8 +50,9 @@ func NewLog(dir string, c Config) (*Log, error) {
 		c.Segment.MaxStoreBytes = 1024
 	}
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:      dir,
+		Config:   c,
+		appended: make(chan struct{}),
 	}
 	return l, l.setup()
 }
@@ -47,7 +68,7 @@ func (l *Log) setup() error {
 	var baseOffsets []uint64
 	for _, f := range files {
 		ext := path.Ext(f.Name())
-		if ext != ".index" {
+		if ext == ".store" {
 			offStr := strings.TrimSuffix(f.Name(), ext)
 			off, _ := strconv.ParseUint(offStr, 10, 0)
 			baseOffsets = append(baseOffsets, off)
@@ -70,25 +91,321 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
+
+	// Roll over if the last segment was left full
+	if l.activeSegment.IsMaxed() {
+		if err = l.newSegment(l.activeSegment.nextOffset); err != nil {
+			return err
+		}
+	}
+	return l.restore()
+}
+
+// restore rebuilds the idempotent producer and transaction state from the
+// latest state snapshot at or before the log's next offset, replaying the
+// records appended after it
+func (l *Log) restore() error {
+	st, from, err := l.loadState(l.activeSegment.nextOffset)
+	if err != nil {
+		return err
+	}
+	l.producers, l.txns, l.topic = st.restore()
+	for _, seg := range l.segments {
+		if from < seg.baseOffset {
+			from = seg.baseOffset
+		}
+		if from >= seg.nextOffset {
+			continue
+		}
+		records, _, err := seg.ReadBatch(from, 0, 0)
+		if err != nil {
+			return err
+		}
+		for _, rec := range records {
+			l.apply(rec)
+		}
+	}
 	return nil
 }
 
-func (l *Log) Append(record *api.Record) (uint64, error) {
+// apply updates the producer, transaction and topic state with an
+// appended record
+func (l *Log) apply(record *api.Record) {
+	if record.ProducerId != 0 {
+		l.producers.Add(record.ProducerId, record.Sequence, record.Offset)
+	}
+	if record.Control == api.Record_TOPIC_CONFIG {
+		c := &api.TopicConfig{}
+		if err := proto.Unmarshal(record.Value, c); err == nil {
+			l.topic = c
+		}
+		return
+	}
+	l.txns.Apply(record)
+}
+
+// Append appends the record to the active segment and returns its offset.
+// A record from an idempotent producer that was already appended is not
+// appended again; its original offset is returned instead. Transaction
+// markers and transactional records must refer to an open transaction.
+// The append is traced as a child of the span in ctx, marking when the
+// lock was acquired and spanning the segment write and any roll.
+func (l *Log) Append(ctx context.Context, record *api.Record) (
+	off uint64,
+	err error,
+) {
+	ctx, span := tracer.Start(ctx, "log.Append")
+	defer func() {
+		endSpan(span, err, attribute.Int64("offset", int64(off)))
+	}()
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	off, err := l.activeSegment.Append(record)
+	span.AddEvent("lock acquired")
+	if l.closed {
+		return 0, api.ErrLogClosed{}
+	}
+	max := l.Config.Segment.MaxRecordBytes
+	if size := uint64(proto.Size(record)); max > 0 && size > max {
+		return 0, api.ErrRecordTooLarge{Size: size, Max: max}
+	}
+	if record.ProducerId != 0 {
+		off, dup, err := l.producers.Check(record.ProducerId, record.Sequence)
+		if err != nil || dup {
+			return off, err
+		}
+	}
+	if record.Control == api.Record_TOPIC_CONFIG {
+		err = checkTopicConfig(record)
+	} else {
+		err = l.txns.Check(record)
+	}
 	if err != nil {
 		return 0, err
 	}
+	return l.append(ctx, record)
+}
+
+// AppendTxn appends records to the open transaction id at once and returns
+// their offsets: they're all checked first, as Append checks a record, and
+// none is appended if any fails its check. Only data records and offset
+// commits are added this way; the transaction's markers are appended with
+// Append.
+func (l *Log) AppendTxn(ctx context.Context, id uint64, records []*api.Record) (
+	offs []uint64,
+	err error,
+) {
+	ctx, span := tracer.Start(ctx, "log.AppendTxn")
+	defer func() {
+		endSpan(span, err,
+			attribute.Int64("transaction_id", int64(id)),
+			attribute.Int("records", len(records)),
+		)
+	}()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, api.ErrLogClosed{}
+	}
+	offs, err = l.checkTxn(id, records)
+	if err != nil {
+		return nil, err
+	}
+	for i, record := range records {
+		if offs[i] != noOffset {
+			continue
+		}
+		if offs[i], err = l.append(ctx, record); err != nil {
+			return nil, err
+		}
+	}
+	return offs, nil
+}
+
+// noOffset marks the records of a transaction checkTxn found still to be
+// appended
+const noOffset = ^uint64(0)
+
+// checkTxn checks the records added to the transaction id together. It
+// returns the offsets duplicates from idempotent producers were already
+// appended at and noOffset for the records to append.
+func (l *Log) checkTxn(id uint64, records []*api.Record) ([]uint64, error) {
+	max := l.Config.Segment.MaxRecordBytes
+	// Sequences are checked against those appended before the batch and
+	// those earlier in it
+	pending := make(producers)
+	next := l.activeSegment.nextOffset
+	offs := make([]uint64, len(records))
+	for i, record := range records {
+		if record.Control != api.Record_DATA &&
+			record.Control != api.Record_OFFSET_COMMIT {
+			return nil, fmt.Errorf(
+				"%s marker added to transaction %d", record.Control, id,
+			)
+		}
+		record.TransactionId = id
+		if size := uint64(proto.Size(record)); max > 0 && size > max {
+			return nil, api.ErrRecordTooLarge{Size: size, Max: max}
+		}
+		if err := l.txns.Check(record); err != nil {
+			return nil, err
+		}
+		offs[i] = noOffset
+		if record.ProducerId == 0 {
+			next++
+			continue
+		}
+		if _, ok := pending[record.ProducerId]; !ok {
+			if entries, ok := l.producers[record.ProducerId]; ok {
+				pending[record.ProducerId] = append([]producerEntry(nil), entries...)
+			}
+		}
+		off, dup, err := pending.Check(record.ProducerId, record.Sequence)
+		if err != nil {
+			return nil, err
+		}
+		if dup {
+			offs[i] = off
+			continue
+		}
+		pending.Add(record.ProducerId, record.Sequence, next)
+		next++
+	}
+	return offs, nil
+}
+
+// appendReplica appends a record replicated from another log as it is. Its
+// transaction id is the one the other log gave it, and it isn't checked
+// against this log's producer and transaction state, which may begin after
+// the record's producer or transaction did.
+func (l *Log) appendReplica(ctx context.Context, record *api.Record) (
+	off uint64,
+	err error,
+) {
+	ctx, span := tracer.Start(ctx, "log.appendReplica")
+	defer func() {
+		endSpan(span, err, attribute.Int64("offset", int64(off)))
+	}()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, api.ErrLogClosed{}
+	}
+	return l.append(ctx, record)
+}
+
+// append writes a checked record to the active segment and applies it,
+// rolling the segment once it's full
+func (l *Log) append(ctx context.Context, record *api.Record) (
+	off uint64,
+	err error,
+) {
+	size := l.activeSegment.store.size
+	_, segSpan := tracer.Start(ctx, "segment.Append")
+	off, err = l.activeSegment.Append(record)
+	endSpan(segSpan, err)
+	if err != nil {
+		return 0, err
+	}
+	l.appendedBytes += l.activeSegment.store.size - size
+	l.apply(record)
+
+	// Wake up anyone waiting on the head of the log
+	close(l.appended)
+	l.appended = make(chan struct{})
+
+	// Sync full segments to disk as they're rolled
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+		err = l.roll(ctx, off+1)
 	}
 	return off, err
 }
 
-func (l *Log) Read(off uint64) (*api.Record, error) {
+// roll syncs the full active segment and starts a new one at off
+func (l *Log) roll(ctx context.Context, off uint64) (err error) {
+	_, span := tracer.Start(ctx, "log.roll")
+	defer func() {
+		endSpan(span, err, attribute.Int64("base_offset", int64(off)))
+	}()
+	if err = l.sync(l.activeSegment); err != nil {
+		return err
+	}
+	if err = l.newSegment(off); err != nil {
+		return err
+	}
+	return l.saveState()
+}
+
+// endSpan records the attributes and error of an operation on its span and
+// ends it
+func endSpan(span trace.Span, err error, attrs ...attribute.KeyValue) {
+	span.SetAttributes(attrs...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// sync writes the segment through to disk, reporting how long it took to
+// the Config's OnSync
+func (l *Log) sync(seg *segment) error {
+	start := time.Now()
+	err := seg.Sync()
+	if l.Config.OnSync != nil {
+		l.Config.OnSync(time.Since(start))
+	}
+	return err
+}
+
+// Sync writes the records appended so far through to disk, so they survive
+// a crash.
+func (l *Log) Sync() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.closed {
+		return api.ErrLogClosed{}
+	}
+	return l.sync(l.activeSegment)
+}
+
+func (l *Log) Read(ctx context.Context, off uint64) (
+	record *api.Record,
+	err error,
+) {
+	_, span := tracer.Start(ctx, "log.Read")
+	defer func() { endSpan(span, err, attribute.Int64("offset", int64(off))) }()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.read(off)
+}
+
+// ReadCommitted reads the first record at or after off that is visible to
+// READ_COMMITTED readers. Records at or past the last stable offset, the
+// start of the earliest open transaction, are out of range until it ends.
+func (l *Log) ReadCommitted(ctx context.Context, off uint64) (
+	record *api.Record,
+	err error,
+) {
+	_, span := tracer.Start(ctx, "log.ReadCommitted")
+	defer func() { endSpan(span, err, attribute.Int64("offset", int64(off))) }()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for cur, stable := off, l.lastStableOffset(); cur < stable; cur++ {
+		rec, err := l.read(cur)
+		if err != nil {
+			return nil, err
+		}
+		if l.txns.Visible(rec) {
+			return rec, nil
+		}
+	}
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+func (l *Log) read(off uint64) (*api.Record, error) {
+	if l.closed {
+		return nil, api.ErrLogClosed{}
+	}
 	// Find the segment with the given offset and read from it
 	for _, seg := range l.segments {
 		if off < seg.nextOffset && off >= seg.baseOffset {
@@ -99,16 +416,210 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 
 }
 
-// Close closes each of the segments
+// ReadBatch reads a contiguous batch of records starting at off, bounded by
+// maxRecords and maxBytes as described by segment.ReadBatch. The batch may
+// span segments and holds at least one record even if that record alone is
+// larger than maxBytes. Reading at the head of the log returns no records
+// and no error so callers can wait for the next append.
+func (l *Log) ReadBatch(ctx context.Context, off, maxRecords, maxBytes uint64) (
+	records []*api.Record,
+	err error,
+) {
+	_, span := tracer.Start(ctx, "log.ReadBatch")
+	defer func() { endBatchSpan(span, err, off, records) }()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.readBatch(off, maxRecords, maxBytes)
+}
+
+// ReadBatchCommitted is ReadBatch for READ_COMMITTED readers. Hidden
+// records are dropped from the batch and reads stop at the last stable
+// offset, so an empty batch may be returned before the head of the log.
+func (l *Log) ReadBatchCommitted(
+	ctx context.Context,
+	off, maxRecords, maxBytes uint64,
+) (visible []*api.Record, err error) {
+	_, span := tracer.Start(ctx, "log.ReadBatchCommitted")
+	defer func(start uint64) { endBatchSpan(span, err, start, visible) }(off)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, api.ErrLogClosed{}
+	}
+	if off > l.activeSegment.nextOffset {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	for stable := l.lastStableOffset(); off < stable; {
+		limit := stable - off
+		if maxRecords > 0 && maxRecords < limit {
+			limit = maxRecords
+		}
+		batch, err := l.readBatch(off, limit, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		off += uint64(len(batch))
+
+		// Skip ahead when every record in the batch is hidden
+		var records []*api.Record
+		for _, rec := range batch {
+			if l.txns.Visible(rec) {
+				records = append(records, rec)
+			}
+		}
+		if len(records) > 0 {
+			return records, nil
+		}
+	}
+	return nil, nil
+}
+
+// endBatchSpan ends the span of a batch read from off
+func endBatchSpan(span trace.Span, err error, off uint64, records []*api.Record) {
+	endSpan(
+		span,
+		err,
+		attribute.Int64("offset", int64(off)),
+		attribute.Int("records", len(records)),
+	)
+}
+
+func (l *Log) readBatch(off, maxRecords, maxBytes uint64) ([]*api.Record, error) {
+	if l.closed {
+		return nil, api.ErrLogClosed{}
+	}
+	if off == l.activeSegment.nextOffset {
+		return nil, nil
+	}
+
+	// Find the segment holding the first record
+	i := 0
+	for ; i < len(l.segments); i++ {
+		seg := l.segments[i]
+		if off < seg.nextOffset && off >= seg.baseOffset {
+			break
+		}
+	}
+	if i == len(l.segments) {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+
+	// Read from each segment until the batch limits are reached
+	var records []*api.Record
+	for _, seg := range l.segments[i:] {
+		if off >= seg.nextOffset {
+			break
+		}
+		batch, n, err := seg.ReadBatch(off, maxRecords, maxBytes)
+		if err == nil && len(records) == 0 && len(batch) == 0 {
+			// Always make progress with at least one record
+			batch, n, err = seg.ReadBatch(off, 1, 0)
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, batch...)
+		off += uint64(len(batch))
+
+		// Stop when the limits cut the segment short or are used up
+		if off < seg.nextOffset {
+			break
+		}
+		if maxRecords > 0 {
+			if maxRecords -= uint64(len(batch)); maxRecords == 0 {
+				break
+			}
+		}
+		if maxBytes > 0 {
+			if n >= maxBytes {
+				break
+			}
+			maxBytes -= n
+		}
+	}
+	return records, nil
+}
+
+// CommittedOffset returns the offset last committed by the consumer group.
+func (l *Log) CommittedOffset(group string) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	off, ok := l.txns.offsets[group]
+	if !ok {
+		return 0, api.ErrGroupNotFound{Group: group}
+	}
+	return off, nil
+}
+
+// Stats is a snapshot of a log's size, offsets and consumer groups.
+type Stats struct {
+	Segments           int
+	ActiveSegmentBytes uint64
+	LowestOffset       uint64
+	// NextOffset is the offset the next record will be appended at
+	NextOffset uint64
+	// AppendedBytes counts the bytes appended since the log was opened
+	AppendedBytes uint64
+	// CommittedOffsets maps each consumer group to its committed offset
+	CommittedOffsets map[string]uint64
+}
+
+// Stats returns a snapshot of the log's statistics.
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stats := Stats{
+		Segments:           len(l.segments),
+		ActiveSegmentBytes: l.activeSegment.store.size,
+		LowestOffset:       l.segments[0].baseOffset,
+		NextOffset:         l.activeSegment.nextOffset,
+		AppendedBytes:      l.appendedBytes,
+		CommittedOffsets:   make(map[string]uint64, len(l.txns.offsets)),
+	}
+	for group, off := range l.txns.offsets {
+		stats.CommittedOffsets[group] = off
+	}
+	return stats
+}
+
+// lastStableOffset returns the offset READ_COMMITTED readers may read up
+// to: the start of the earliest open transaction or the head of the log.
+func (l *Log) lastStableOffset() uint64 {
+	if first, ok := l.txns.FirstOpen(); ok {
+		return first
+	}
+	return l.activeSegment.nextOffset
+}
+
+// Wait returns a channel that is closed by the next append to the log.
+func (l *Log) Wait() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.appended
+}
+
+// Close flushes each of the segments to disk and closes them. Any later
+// reads and appends fail with ErrLogClosed and those waiting on the log
+// are woken up.
 func (l *Log) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	// Close every segment even if one fails so none is left unflushed
+	err := l.sync(l.activeSegment)
+	if serr := l.saveState(); err == nil {
+		err = serr
+	}
 	for _, seg := range l.segments {
-		if err := seg.Close(); err != nil {
-			return err
+		if cerr := seg.Close(); cerr != nil && err == nil {
+			err = cerr
 		}
 	}
-	return nil
+	l.closed = true
+	close(l.appended)
+	return err
 }
 
 // Remove removes all files from the log directory
@@ -125,9 +636,28 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments = nil
+	l.closed = false
+	l.appended = make(chan struct{})
 	return l.setup()
 }
 
+// Ready returns nil while the log is open, and api.ErrLogClosed once it's
+// closed.
+func (l *Log) Ready() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return api.ErrLogClosed{}
+	}
+	return nil
+}
+
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -147,12 +677,18 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return maxUint64(l.segments[lastIdx].nextOffset-1, uint64(0)), nil
 }
 
+// Reader returns a reader of the log's stores as they are now. Records
+// appended later aren't read; reading a segment that's since been removed
+// fails.
 func (l *Log) Reader() io.Reader {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	var readers []io.Reader
 	for _, seg := range l.segments {
-		readers = append(readers, &originReader{seg.store, 0})
+		readers = append(readers, io.LimitReader(
+			&originReader{seg.store, 0},
+			int64(seg.store.size),
+		))
 	}
 	return io.MultiReader(readers...)
 }
@@ -184,7 +720,33 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
-	return nil
+	// The state snapshots keep the truncated records' producers and
+	// transactions
+	return l.pruneStates()
+}
+
+// TruncateFrom drops the records at off and after it, so the next record
+// is appended at off, or at the log's lowest offset if off is below it.
+// It's how a Raft follower discards the entries that conflict with its
+// leader's.
+func (l *Log) TruncateFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return api.ErrLogClosed{}
+	}
+	for len(l.segments) > 1 && l.segments[len(l.segments)-1].baseOffset >= off {
+		if err := l.segments[len(l.segments)-1].Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+	}
+	l.activeSegment = l.segments[len(l.segments)-1]
+	if err := l.activeSegment.TruncateFrom(off); err != nil {
+		return err
+	}
+	// The dropped records may have begun transactions or producers
+	return l.restore()
 }
 
 func (l *Log) newSegment(off uint64) error {
@@ -1,9 +1,12 @@
 package log
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/require"
@@ -23,7 +26,16 @@ func TestLog(t *testing.T) {
 		"offset out of range error":         testOutOfRangeErr,
 		"init with existing segments":       testInitExisting,
 		"truncate":                          testTruncate,
+		"truncate from":                     testTruncateFrom,
 		"reader":                            testReader,
+		"read batch across segments":        testReadBatch,
+		"idempotent producer":               testIdempotentProducer,
+		"read committed transactions":       testTransactions,
+		"append to a transaction at once":   testAppendTxn,
+		"topic config":                      testTopicConfig,
+		"closed log errors":                 testClosed,
+		"record too large error":            testRecordTooLarge,
+		"stats":                             testStats,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -40,17 +52,19 @@ func TestLog(t *testing.T) {
 }
 
 func testAppendRead(t *testing.T, log *Log) {
-	off, err := log.Append(_append)
+	ctx := context.Background()
+	off, err := log.Append(ctx, _append)
 	require.NoError(t, err)
 	require.Equal(t, uint64(0), off)
 
-	read, err := log.Read(off)
+	read, err := log.Read(ctx, off)
 	require.NoError(t, err)
 	require.Equal(t, _append.Value, read.Value)
 }
 
 func testOutOfRangeErr(t *testing.T, log *Log) {
-	read, err := log.Read(1)
+	ctx := context.Background()
+	read, err := log.Read(ctx, 1)
 	require.Nil(t, read)
 	apiErr, ok := err.(api.ErrOffsetOutOfRange)
 	require.True(t, ok)
@@ -58,6 +72,7 @@ func testOutOfRangeErr(t *testing.T, log *Log) {
 }
 
 func testInitExisting(t *testing.T, log *Log) {
+	ctx := context.Background()
 	var (
 		minOff = uint64(0)
 		maxOff = uint64(2)
@@ -65,7 +80,7 @@ func testInitExisting(t *testing.T, log *Log) {
 
 	// Append to log and close it
 	for i := 0; i < 3; i++ {
-		_, err := log.Append(_append)
+		_, err := log.Append(ctx, _append)
 		require.NoError(t, err)
 	}
 	require.NoError(t, log.Close())
@@ -90,7 +105,8 @@ func validateOffsets(t *testing.T, log *Log, min, max uint64) {
 }
 
 func testReader(t *testing.T, log *Log) {
-	off, err := log.Append(_append)
+	ctx := context.Background()
+	off, err := log.Append(ctx, _append)
 	require.NoError(t, err)
 	require.Equal(t, uint64(0), off)
 
@@ -105,13 +121,375 @@ func testReader(t *testing.T, log *Log) {
 }
 
 func testTruncate(t *testing.T, log *Log) {
+	ctx := context.Background()
 	for i := 0; i < 3; i++ {
-		_, err := log.Append(_append)
+		_, err := log.Append(ctx, _append)
 		require.NoError(t, err)
 	}
 	err := log.Truncate(1)
 	require.NoError(t, err)
 
-	_, err = log.Read(0)
+	_, err = log.Read(ctx, 0)
 	require.Error(t, err)
 }
+
+func testTruncateFrom(t *testing.T, log *Log) {
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(ctx, _append)
+		require.NoError(t, err)
+	}
+
+	err := log.TruncateFrom(1)
+	require.NoError(t, err)
+	validateOffsets(t, log, 0, 0)
+	_, err = log.Read(ctx, 1)
+	require.Error(t, err)
+
+	// The next record takes the first dropped offset
+	off, err := log.Append(ctx, _append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	validateOffsets(t, n, 0, 1)
+}
+
+func testReadBatch(t *testing.T, log *Log) {
+	ctx := context.Background()
+	// Reading at the head of an empty log returns nothing
+	records, err := log.ReadBatch(ctx, 0, 0, 0)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	// Fill several segments
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(ctx, _append)
+		require.NoError(t, err)
+	}
+
+	// Unbounded batch reads to the head
+	records, err = log.ReadBatch(ctx, 1, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	for i, rec := range records {
+		require.Equal(t, uint64(1+i), rec.Offset)
+		require.Equal(t, _append.Value, rec.Value)
+	}
+
+	// Record limit
+	records, err = log.ReadBatch(ctx, 0, 3, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	// Byte limit still returns at least one record
+	records, err = log.ReadBatch(ctx, 0, 0, 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	// Past the head is out of range
+	_, err = log.ReadBatch(ctx, 6, 0, 0)
+	require.Error(t, err)
+}
+
+func testIdempotentProducer(t *testing.T, log *Log) {
+	ctx := context.Background()
+	produce := func(seq uint64) (uint64, error) {
+		return log.Append(ctx, &api.Record{
+			Value:      []byte("hello world"),
+			ProducerId: 7,
+			Sequence:   seq,
+		})
+	}
+	for seq := uint64(0); seq < 3; seq++ {
+		off, err := produce(seq)
+		require.NoError(t, err)
+		require.Equal(t, seq, off)
+	}
+
+	// Retrying a recent sequence returns its original offset
+	off, err := produce(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+
+	// Skipping a sequence is rejected
+	_, err = produce(5)
+	apiErr, ok := err.(api.ErrOutOfOrderSequence)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), apiErr.Expected)
+
+	// Producer state survives a restart
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	off, err = produce(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = produce(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// and truncating the producer's records, even across a restart
+	require.NoError(t, log.Truncate(2))
+	_, err = log.Read(ctx, 2)
+	require.Error(t, err)
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err = produce(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	_, err = produce(5)
+	_, ok = err.(api.ErrOutOfOrderSequence)
+	require.True(t, ok)
+}
+
+func testTransactions(t *testing.T, log *Log) {
+	ctx := context.Background()
+	begin := func() uint64 {
+		marker := &api.Record{Control: api.Record_BEGIN}
+		_, err := log.Append(ctx, marker)
+		require.NoError(t, err)
+		return marker.TransactionId
+	}
+	appendTo := func(txn uint64, control api.Record_Control) uint64 {
+		off, err := log.Append(ctx, &api.Record{
+			Value:         []byte("hello world"),
+			TransactionId: txn,
+			Control:       control,
+		})
+		require.NoError(t, err)
+		return off
+	}
+
+	// A plain record before the transactions is visible
+	appendTo(0, api.Record_DATA)
+
+	// Records of an open transaction are hidden
+	committed := begin()
+	want := appendTo(committed, api.Record_DATA)
+	oc, err := proto.Marshal(&api.OffsetCommit{Group: "g", Offset: 42})
+	require.NoError(t, err)
+	_, err = log.Append(ctx, &api.Record{
+		Value:         oc,
+		TransactionId: committed,
+		Control:       api.Record_OFFSET_COMMIT,
+	})
+	require.NoError(t, err)
+	_, err = log.ReadCommitted(ctx, 1)
+	require.Error(t, err)
+	_, err = log.CommittedOffset("g")
+	require.Error(t, err)
+
+	// Records of an aborted transaction stay hidden
+	aborted := begin()
+	appendTo(aborted, api.Record_DATA)
+	appendTo(aborted, api.Record_ABORT)
+	appendTo(committed, api.Record_COMMIT)
+
+	rec, err := log.ReadCommitted(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, want, rec.Offset)
+	records, err := log.ReadBatchCommitted(ctx, 0, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, want, records[1].Offset)
+	off, err := log.CommittedOffset("g")
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), off)
+
+	// Ended transactions accept no more records
+	_, err = log.Append(ctx, &api.Record{TransactionId: committed})
+	_, ok := err.(api.ErrTransactionNotOpen)
+	require.True(t, ok)
+
+	// Transaction state survives a restart
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	records, err = log.ReadBatchCommitted(ctx, 0, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.NotEqual(t, committed, begin())
+}
+
+func testAppendTxn(t *testing.T, log *Log) {
+	ctx := context.Background()
+	marker := &api.Record{Control: api.Record_BEGIN}
+	_, err := log.Append(ctx, marker)
+	require.NoError(t, err)
+	txn := marker.TransactionId
+	data := func(value string, seq uint64) *api.Record {
+		return &api.Record{Value: []byte(value), ProducerId: 7, Sequence: seq}
+	}
+	oc, err := proto.Marshal(&api.OffsetCommit{Group: "g", Offset: 42})
+	require.NoError(t, err)
+
+	// Records and offset commits are appended together
+	offs, err := log.AppendTxn(ctx, txn, []*api.Record{
+		data("first", 0),
+		data("second", 1),
+		{Value: oc, Control: api.Record_OFFSET_COMMIT},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3}, offs)
+	rec, err := log.Read(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, txn, rec.TransactionId)
+
+	// Retried sequences keep their offsets, even beside new ones
+	offs, err = log.AppendTxn(ctx, txn, []*api.Record{
+		data("second", 1),
+		data("third", 2),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 4}, offs)
+
+	// None of a batch is appended if any record fails its check
+	for _, records := range [][]*api.Record{
+		{data("fourth", 3), data("sixth", 5)},
+		{data("fourth", 3), {Value: []byte("bad"), Control: api.Record_OFFSET_COMMIT}},
+		{data("fourth", 3), {Control: api.Record_COMMIT}},
+	} {
+		_, err = log.AppendTxn(ctx, txn, records)
+		require.Error(t, err)
+		highest, err := log.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), highest)
+	}
+	log.Config.Segment.MaxRecordBytes = 32
+	_, err = log.AppendTxn(ctx, txn, []*api.Record{
+		data("fourth", 3),
+		data(strings.Repeat("too large", 4), 4),
+	})
+	_, ok := err.(api.ErrRecordTooLarge)
+	require.True(t, ok)
+
+	// and nothing is added to transactions that aren't open
+	_, err = log.AppendTxn(ctx, txn+1, []*api.Record{data("fourth", 3)})
+	_, ok = err.(api.ErrTransactionNotOpen)
+	require.True(t, ok)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+}
+
+func testTopicConfig(t *testing.T, log *Log) {
+	ctx := context.Background()
+	configure := func(c *api.TopicConfig) error {
+		value, err := proto.Marshal(c)
+		require.NoError(t, err)
+		_, err = log.Append(ctx, &api.Record{
+			Value:   value,
+			Control: api.Record_TOPIC_CONFIG,
+		})
+		return err
+	}
+
+	// Topics need at least one replica in sync until configured otherwise
+	require.Equal(t, uint64(1), log.TopicConfig().MinInsyncReplicas)
+	require.Error(t, configure(&api.TopicConfig{}))
+	require.NoError(t, configure(&api.TopicConfig{MinInsyncReplicas: 2}))
+	require.Equal(t, uint64(2), log.TopicConfig().MinInsyncReplicas)
+
+	// The marker is hidden from READ_COMMITTED readers
+	_, err := log.Append(ctx, _append)
+	require.NoError(t, err)
+	records, err := log.ReadBatchCommitted(ctx, 0, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, api.Record_DATA, records[0].Control)
+
+	// The config survives its marker being truncated, across a restart
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(ctx, _append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Truncate(2))
+	_, err = log.Read(ctx, 0)
+	require.Error(t, err)
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, uint64(2), log.TopicConfig().MinInsyncReplicas)
+}
+
+func testClosed(t *testing.T, log *Log) {
+	ctx := context.Background()
+	_, err := log.Append(ctx, _append)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	require.NoError(t, log.Close())
+
+	_, err = log.Append(ctx, _append)
+	require.Equal(t, api.ErrLogClosed{}, err)
+	_, err = log.Read(ctx, 0)
+	require.Equal(t, api.ErrLogClosed{}, err)
+	_, err = log.ReadBatch(ctx, 0, 0, 0)
+	require.Equal(t, api.ErrLogClosed{}, err)
+
+	// Waiters are woken up
+	select {
+	case <-log.Wait():
+	default:
+		t.Fatal("wait channel open after close")
+	}
+}
+
+func testRecordTooLarge(t *testing.T, log *Log) {
+	ctx := context.Background()
+	log.Config.Segment.MaxRecordBytes = uint64(len(_append.Value))
+	_, err := log.Append(ctx, _append)
+	apiErr, ok := err.(api.ErrRecordTooLarge)
+	require.True(t, ok)
+	require.Equal(t, uint64(len(_append.Value)), apiErr.Max)
+}
+
+func testStats(t *testing.T, log *Log) {
+	ctx := context.Background()
+	var syncs int
+	log.Config.OnSync = func(time.Duration) { syncs++ }
+
+	// Each record fills a segment, which is synced as it's rolled
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(ctx, _append)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, syncs)
+
+	// Commit an offset for a consumer group
+	begin, err := log.Append(ctx, &api.Record{Control: api.Record_BEGIN})
+	require.NoError(t, err)
+	marker, err := log.Read(ctx, begin)
+	require.NoError(t, err)
+	oc, err := proto.Marshal(&api.OffsetCommit{Group: "g", Offset: 1})
+	require.NoError(t, err)
+	for _, rec := range []*api.Record{
+		{Value: oc, Control: api.Record_OFFSET_COMMIT},
+		{Control: api.Record_COMMIT},
+	} {
+		rec.TransactionId = marker.TransactionId
+		_, err = log.Append(ctx, rec)
+		require.NoError(t, err)
+	}
+
+	stats := log.Stats()
+	require.Equal(t, syncs+1, stats.Segments)
+	require.Equal(t, uint64(0), stats.LowestOffset)
+	require.Equal(t, uint64(5), stats.NextOffset)
+	want := 2 * (lenWidth + uint64(proto.Size(_append)))
+	require.Less(t, want, stats.AppendedBytes)
+	require.Equal(t, map[string]uint64{"g": 1}, stats.CommittedOffsets)
+
+	// Closing syncs the active segment
+	rolled := syncs
+	require.NoError(t, log.Close())
+	require.Equal(t, rolled+1, syncs)
+}
@@ -0,0 +1,51 @@
+package log
+
+import (
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+// producerWindow is the number of recent sequences remembered for each
+// producer so that retries of requests still in flight are deduplicated.
+const producerWindow = 5
+
+type producerEntry struct {
+	sequence, offset uint64
+}
+
+// producers tracks the latest appended sequences of each idempotent
+// producer, oldest first.
+type producers map[uint64][]producerEntry
+
+// Check looks up the sequence of an idempotent append. It returns the
+// offset the sequence was already appended at, or an error if the sequence
+// is neither a known duplicate nor the next one expected. Unknown producers
+// may start at any sequence.
+func (p producers) Check(id, seq uint64) (off uint64, dup bool, err error) {
+	entries, ok := p[id]
+	if !ok {
+		return 0, false, nil
+	}
+	last := entries[len(entries)-1]
+	if seq == last.sequence+1 {
+		return 0, false, nil
+	}
+	for _, e := range entries {
+		if e.sequence == seq {
+			return e.offset, true, nil
+		}
+	}
+	return 0, false, api.ErrOutOfOrderSequence{
+		ProducerId: id,
+		Sequence:   seq,
+		Expected:   last.sequence + 1,
+	}
+}
+
+// Add remembers that the producer's sequence was appended at off.
+func (p producers) Add(id, seq, off uint64) {
+	entries := append(p[id], producerEntry{sequence: seq, offset: off})
+	if len(entries) > producerWindow {
+		entries = entries[len(entries)-producerWindow:]
+	}
+	p[id] = entries
+}
@@ -0,0 +1,302 @@
+package log
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// defaultReplicaLagTimeout is how long a follower may go without catching
+// up with the leader before it's no longer in sync, unless configured
+const defaultReplicaLagTimeout = 10 * time.Second
+
+// replicaTransport is the transport a leader replicates its log over,
+// tracking how far each follower has got from the responses to its appends.
+// A follower is in sync while it keeps catching up with the leader's last
+// entry within the lag timeout. On a follower it tracks the leader's commit
+// index from the appends it receives instead.
+type replicaTransport struct {
+	*raft.NetworkTransport
+	// lastIndex returns the index of the leader's last entry
+	lastIndex  func() (uint64, error)
+	lagTimeout time.Duration
+	rpcs       chan raft.RPC
+	shutdown   chan struct{}
+	closeOnce  sync.Once
+
+	mu       sync.Mutex
+	replicas map[raft.ServerID]replica
+	changed  chan struct{}
+	// leaderCommit is the highest commit index a leader has sent
+	leaderCommit uint64
+	// appliedAt is when the node last had applied every entry up to it
+	appliedAt time.Time
+}
+
+// replica is a follower's progress as of its last successful append
+type replica struct {
+	// match is the index of the follower's last entry matching the leader's
+	match uint64
+	// caughtUp is when the follower last had every entry the leader had
+	caughtUp time.Time
+}
+
+func newReplicaTransport(
+	transport *raft.NetworkTransport,
+	lastIndex func() (uint64, error),
+	lagTimeout time.Duration,
+) *replicaTransport {
+	if lagTimeout == 0 {
+		lagTimeout = defaultReplicaLagTimeout
+	}
+	t := &replicaTransport{
+		NetworkTransport: transport,
+		lastIndex:        lastIndex,
+		lagTimeout:       lagTimeout,
+		rpcs:             make(chan raft.RPC),
+		shutdown:         make(chan struct{}),
+		replicas:         make(map[raft.ServerID]replica),
+		changed:          make(chan struct{}),
+	}
+	go t.consume()
+	return t
+}
+
+// Consumer returns the channel Raft receives the node's RPCs on.
+func (t *replicaTransport) Consumer() <-chan raft.RPC {
+	return t.rpcs
+}
+
+// consume passes the RPCs the node receives on to Raft until the transport
+// closes, noting the commit index of the leader's appends
+func (t *replicaTransport) consume() {
+	for {
+		var rpc raft.RPC
+		select {
+		case rpc = <-t.NetworkTransport.Consumer():
+		case <-t.shutdown:
+			return
+		}
+		if req, ok := rpc.Command.(*raft.AppendEntriesRequest); ok {
+			t.mu.Lock()
+			if req.LeaderCommitIndex > t.leaderCommit {
+				t.leaderCommit = req.LeaderCommitIndex
+			}
+			t.mu.Unlock()
+		}
+		select {
+		case t.rpcs <- rpc:
+		case <-t.shutdown:
+			return
+		}
+	}
+}
+
+// Close stops passing RPCs to Raft and closes the network transport.
+func (t *replicaTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.shutdown)
+	})
+	return t.NetworkTransport.Close()
+}
+
+// AppendEntriesPipeline pipelines appends to the follower, recording its
+// progress as the responses to them come back.
+func (t *replicaTransport) AppendEntriesPipeline(
+	id raft.ServerID,
+	target raft.ServerAddress,
+) (raft.AppendPipeline, error) {
+	pipeline, err := t.NetworkTransport.AppendEntriesPipeline(id, target)
+	if err != nil {
+		return nil, err
+	}
+	return newReplicaPipeline(t, id, pipeline), nil
+}
+
+// AppendEntries sends the entries to the follower and records its progress
+// once it has appended them.
+func (t *replicaTransport) AppendEntries(
+	id raft.ServerID,
+	target raft.ServerAddress,
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+) error {
+	// Everything the leader has now is what the follower must catch up to
+	last, lastErr := t.lastIndex()
+	err := t.NetworkTransport.AppendEntries(id, target, args, resp)
+	if err != nil {
+		return err
+	}
+	t.progress(id, args, resp, sentAt{last: last, err: lastErr})
+	return nil
+}
+
+// sentAt is the leader's last index when it sent an append, or the error
+// looking it up
+type sentAt struct {
+	last uint64
+	err  error
+}
+
+// progress records the follower's progress from its response to an append
+func (t *replicaTransport) progress(
+	id raft.ServerID,
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+	sent sentAt,
+) {
+	// Heartbeats carry no entries and say nothing of the follower's log
+	if !resp.Success || (len(args.Entries) == 0 && args.PrevLogEntry == 0) {
+		return
+	}
+	match := args.PrevLogEntry
+	if n := len(args.Entries); n > 0 {
+		match = args.Entries[n-1].Index
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := t.replicas[id]
+	r.match = match
+	if sent.err == nil && match >= sent.last {
+		r.caughtUp = time.Now()
+	}
+	t.replicas[id] = r
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// replicaPipeline passes a follower's pipelined appends through to the
+// network transport's pipeline and records the follower's progress from
+// each response before Raft consumes it
+type replicaPipeline struct {
+	raft.AppendPipeline
+	transport *replicaTransport
+	id        raft.ServerID
+	futures   chan raft.AppendFuture
+	shutdown  chan struct{}
+	closeOnce sync.Once
+
+	mu sync.Mutex
+	// sent holds when each append still in flight was sent
+	sent map[*raft.AppendEntriesRequest]sentAt
+}
+
+func newReplicaPipeline(
+	t *replicaTransport,
+	id raft.ServerID,
+	pipeline raft.AppendPipeline,
+) *replicaPipeline {
+	p := &replicaPipeline{
+		AppendPipeline: pipeline,
+		transport:      t,
+		id:             id,
+		futures:        make(chan raft.AppendFuture),
+		shutdown:       make(chan struct{}),
+		sent:           make(map[*raft.AppendEntriesRequest]sentAt),
+	}
+	go p.consume()
+	return p
+}
+
+// AppendEntries sends the entries down the pipeline without waiting for
+// the follower's response.
+func (p *replicaPipeline) AppendEntries(
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+) (raft.AppendFuture, error) {
+	last, err := p.transport.lastIndex()
+	p.mu.Lock()
+	p.sent[args] = sentAt{last: last, err: err}
+	p.mu.Unlock()
+	future, err := p.AppendPipeline.AppendEntries(args, resp)
+	if err != nil {
+		p.mu.Lock()
+		delete(p.sent, args)
+		p.mu.Unlock()
+		return nil, err
+	}
+	return future, nil
+}
+
+// Consumer returns the channel Raft receives the appends' futures on once
+// they're done.
+func (p *replicaPipeline) Consumer() <-chan raft.AppendFuture {
+	return p.futures
+}
+
+// consume records the progress of each append that's done and passes its
+// future on to Raft until the pipeline closes
+func (p *replicaPipeline) consume() {
+	for {
+		var future raft.AppendFuture
+		select {
+		case future = <-p.AppendPipeline.Consumer():
+		case <-p.shutdown:
+			return
+		}
+		p.mu.Lock()
+		sent := p.sent[future.Request()]
+		delete(p.sent, future.Request())
+		p.mu.Unlock()
+		if future.Error() == nil {
+			p.transport.progress(p.id, future.Request(), future.Response(), sent)
+		}
+		select {
+		case p.futures <- future:
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// Close stops passing futures to Raft and closes the network transport's
+// pipeline.
+func (p *replicaPipeline) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.shutdown)
+	})
+	return p.AppendPipeline.Close()
+}
+
+// inSync returns the follower's progress and whether it's in sync as of
+// now
+func (t *replicaTransport) inSync(id raft.ServerID, now time.Time) (
+	replica,
+	bool,
+) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.replicas[id]
+	return r, ok && now.Sub(r.caughtUp) <= t.lagTimeout
+}
+
+// wait returns a channel that's closed once a follower has made progress
+func (t *replicaTransport) wait() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.changed
+}
+
+// caughtUp returns nil while the node keeps up with the leader, having
+// applied every entry up to the leader's commit index within the lag
+// timeout
+func (t *replicaTransport) caughtUp(applied uint64, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if applied >= t.leaderCommit {
+		t.appliedAt = now
+		return nil
+	}
+	if now.Sub(t.appliedAt) <= t.lagTimeout {
+		return nil
+	}
+	return fmt.Errorf(
+		"%w: applied %d of %d",
+		ErrBehindLeader,
+		applied,
+		t.leaderCommit,
+	)
+}
@@ -0,0 +1,271 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+// Replicator keeps a follower's log a copy of a leader's without
+// consensus. It tails the leader's log with ConsumeStream and appends the
+// records to the follower's log as they are, so each keeps its offset,
+// append time and transaction id. Whenever the stream breaks it
+// reconnects, dropping any records the leader doesn't have before resuming
+// after the follower's highest offset.
+type Replicator struct {
+	// DialOptions configure the connection to the leader, e.g. its
+	// transport credentials
+	DialOptions []grpc.DialOption
+	// LeaderAddr is the address of the leader's gRPC server
+	LeaderAddr string
+	// Topic names the leader's log, which may be left empty
+	Topic string
+	// Log is the follower's log, which nothing else may append to
+	Log *Log
+	// Backoff is how long to wait before reconnecting, a second when zero
+	Backoff time.Duration
+	// LagInterval is how often the leader's offsets are checked to measure
+	// the lag, every second when zero
+	LagInterval time.Duration
+	// Logger logs why replication was interrupted, when it's set
+	Logger *zap.Logger
+
+	mu         sync.Mutex
+	leaderNext uint64
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// Start replicates the leader's log in the background until Close is
+// called.
+func (r *Replicator) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	go r.run(ctx)
+}
+
+// Close stops replicating and waits for the last append to finish. It
+// doesn't close the follower's log.
+func (r *Replicator) Close() error {
+	r.mu.Lock()
+	cancel, done := r.cancel, r.done
+	r.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	<-done
+	return nil
+}
+
+// Lag returns how many records the follower is behind the leader, as of
+// the leader's offsets last seen.
+func (r *Replicator) Lag() uint64 {
+	r.mu.Lock()
+	leaderNext := r.leaderNext
+	r.mu.Unlock()
+	next := r.Log.Stats().NextOffset
+	if leaderNext > next {
+		return leaderNext - next
+	}
+	return 0
+}
+
+func (r *Replicator) logger() *zap.Logger {
+	if r.Logger == nil {
+		return zap.NewNop()
+	}
+	return r.Logger
+}
+
+// run replicates until ctx is done, reconnecting after each failure
+func (r *Replicator) run(ctx context.Context) {
+	defer close(r.done)
+	backoff := r.Backoff
+	if backoff == 0 {
+		backoff = time.Second
+	}
+	for {
+		err := r.replicate(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		r.logger().Error(
+			"replication interrupted",
+			zap.String("leader", r.LeaderAddr),
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// replicate follows the leader's log until the stream breaks or ctx is
+// done
+func (r *Replicator) replicate(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cc, err := grpc.DialContext(ctx, r.LeaderAddr, r.DialOptions...)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+
+	next, err := r.reconcile(ctx, client)
+	if err != nil {
+		return err
+	}
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Topic:  r.Topic,
+		Offset: next,
+	})
+	if err != nil {
+		return err
+	}
+	go r.trackLag(ctx, client)
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if err = r.append(ctx, res.Record); err != nil {
+			return err
+		}
+	}
+}
+
+// reconcile drops the follower's records that diverge from the leader's
+// and returns the offset to resume replicating from
+func (r *Replicator) reconcile(ctx context.Context, client api.LogClient) (
+	uint64,
+	error,
+) {
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{
+		Topic: r.Topic,
+	})
+	if err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	r.leaderNext = offsets.NextOffset
+	r.mu.Unlock()
+
+	stats := r.Log.Stats()
+	lowest, next := stats.LowestOffset, stats.NextOffset
+	switch {
+	case next == lowest && lowest == offsets.LowestOffset:
+		return next, nil
+	case next == lowest, next < offsets.LowestOffset,
+		lowest > offsets.NextOffset:
+		// The logs don't overlap, so start over where the leader's begins
+		r.Log.Config.Segment.InitialOffset = offsets.LowestOffset
+		return offsets.LowestOffset, r.Log.Reset()
+	}
+
+	// Walk back to the last record both logs have
+	if next > offsets.NextOffset {
+		next = offsets.NextOffset
+	}
+	for next > lowest && next > offsets.LowestOffset {
+		local, err := r.Log.Read(ctx, next-1)
+		if err != nil {
+			return 0, err
+		}
+		res, err := client.Consume(ctx, &api.ConsumeRequest{
+			Topic:  r.Topic,
+			Offset: next - 1,
+		})
+		if err != nil {
+			return 0, err
+		}
+		if proto.Equal(local, res.Record) {
+			break
+		}
+		next--
+	}
+	if next < stats.NextOffset {
+		r.logger().Warn(
+			"truncating divergent tail",
+			zap.String("leader", r.LeaderAddr),
+			zap.Uint64("offset", next),
+			zap.Uint64("records", stats.NextOffset-next),
+		)
+		if err = r.Log.TruncateFrom(next); err != nil {
+			return 0, err
+		}
+	}
+	return next, nil
+}
+
+// append appends a record of the leader's at its own offset, keeping its
+// transaction id
+func (r *Replicator) append(ctx context.Context, record *api.Record) error {
+	want := record.Offset
+	if next := r.Log.Stats().NextOffset; next != want {
+		return fmt.Errorf(
+			"replicated record %d doesn't follow offset %d",
+			want,
+			next-1,
+		)
+	}
+	off, err := r.Log.appendReplica(ctx, record)
+	if err != nil {
+		return err
+	}
+	if off != want {
+		return fmt.Errorf("replicated record %d appended at %d", want, off)
+	}
+	r.observeLeader(off + 1)
+	return nil
+}
+
+// trackLag checks the leader's offsets every LagInterval until ctx is done
+func (r *Replicator) trackLag(ctx context.Context, client api.LogClient) {
+	interval := r.LagInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{
+			Topic: r.Topic,
+		})
+		if err != nil {
+			// The stream fails too when the connection does
+			continue
+		}
+		r.observeLeader(offsets.NextOffset)
+	}
+}
+
+// observeLeader records that the leader's log has reached next
+func (r *Replicator) observeLeader(next uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if next > r.leaderNext {
+		r.leaderNext = next
+	}
+}
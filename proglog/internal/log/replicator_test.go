@@ -0,0 +1,176 @@
+package log
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/mstreet3/proglog/api/v1"
+	"github.com/mstreet3/proglog/internal/server"
+)
+
+func TestReplicator(t *testing.T) {
+	ctx := context.Background()
+	c := Config{}
+	c.Segment.InitialOffset = 3
+	leader := newReplicatorLog(t, c)
+	follower := newReplicatorLog(t, c)
+
+	var records []*api.Record
+	for _, value := range []string{"first", "second", "third"} {
+		record := &api.Record{Value: []byte(value)}
+		_, err := leader.Append(ctx, record)
+		require.NoError(t, err)
+		records = append(records, record)
+	}
+
+	// The follower has the leader's first record, then one of its own
+	_, err := follower.Append(ctx, records[0])
+	require.NoError(t, err)
+	_, err = follower.Append(ctx, &api.Record{Value: []byte("divergent")})
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	srv := serveLog(t, ln, leader)
+
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{grpc.WithInsecure()},
+		LeaderAddr:  addr,
+		Log:         follower,
+		Backoff:     10 * time.Millisecond,
+		LagInterval: 10 * time.Millisecond,
+	}
+	r.Start()
+	defer r.Close()
+
+	// The divergent record is replaced with the leader's
+	requireReplicated(t, follower, records)
+	require.Equal(t, uint64(0), r.Lag())
+
+	// Records appended while following are replicated
+	record := &api.Record{Value: []byte("fourth")}
+	_, err = leader.Append(ctx, record)
+	require.NoError(t, err)
+	records = append(records, record)
+	requireReplicated(t, follower, records)
+
+	// The replicator reconnects once the leader is back
+	srv.Stop()
+	record = &api.Record{Value: []byte("fifth")}
+	_, err = leader.Append(ctx, record)
+	require.NoError(t, err)
+	records = append(records, record)
+	ln, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	srv = serveLog(t, ln, leader)
+	defer srv.Stop()
+	requireReplicated(t, follower, records)
+	require.Equal(t, uint64(0), r.Lag())
+}
+
+func TestReplicatorTransactions(t *testing.T) {
+	ctx := context.Background()
+	c := Config{}
+	// Each segment holds a single record
+	c.Segment.MaxIndexBytes = entWidth
+	leader := newReplicatorLog(t, c)
+	follower := newReplicatorLog(t, c)
+
+	// The first transaction begins before the leader's lowest offset
+	begin := &api.Record{Control: api.Record_BEGIN}
+	_, err := leader.Append(ctx, begin)
+	require.NoError(t, err)
+	var records []*api.Record
+	for _, record := range []*api.Record{
+		{Value: []byte("first"), TransactionId: begin.TransactionId},
+		{Control: api.Record_BEGIN},
+	} {
+		_, err = leader.Append(ctx, record)
+		require.NoError(t, err)
+		records = append(records, record)
+	}
+	require.NoError(t, leader.Truncate(begin.Offset))
+	second := records[1].TransactionId
+	require.NotEqual(t, begin.TransactionId, second)
+	for _, record := range []*api.Record{
+		{Value: []byte("second"), TransactionId: second},
+		{Control: api.Record_COMMIT, TransactionId: begin.TransactionId},
+		{Control: api.Record_COMMIT, TransactionId: second},
+	} {
+		_, err = leader.Append(ctx, record)
+		require.NoError(t, err)
+		records = append(records, record)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := serveLog(t, ln, leader)
+	defer srv.Stop()
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{grpc.WithInsecure()},
+		LeaderAddr:  ln.Addr().String(),
+		Log:         follower,
+		Backoff:     10 * time.Millisecond,
+	}
+	r.Start()
+	defer r.Close()
+
+	// The follower keeps the leader's transaction ids
+	requireReplicated(t, follower, records)
+}
+
+// newReplicatorLog creates a log removed when the test ends
+func newReplicatorLog(t *testing.T, c Config) *Log {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "replicator-test")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	return l
+}
+
+// serveLog serves the log over gRPC on ln
+func serveLog(t *testing.T, ln net.Listener, l *Log) *grpc.Server {
+	t.Helper()
+	srv, err := server.NewGRPCServer(&server.LogRepository{CommitLog: l})
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	return srv
+}
+
+// requireReplicated waits for the follower to hold exactly the records,
+// at the same offsets
+func requireReplicated(t *testing.T, follower *Log, records []*api.Record) {
+	t.Helper()
+	ctx := context.Background()
+	require.Eventually(t, func() bool {
+		highest, err := follower.HighestOffset()
+		if err != nil || highest != records[len(records)-1].Offset {
+			return false
+		}
+		for _, want := range records {
+			got, err := follower.Read(ctx, want.Offset)
+			if err != nil || !proto.Equal(want, got) {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+}
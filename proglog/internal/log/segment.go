@@ -2,11 +2,13 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path"
 
 	api "github.com/mstreet3/proglog/api/v1"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type segment struct {
@@ -48,6 +50,10 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
+	if err = s.recover(); err != nil {
+		return nil, err
+	}
+
 	// Setup next offset from store file state
 	if off, _, err := s.index.Last(); err == nil {
 		s.nextOffset = baseOffset + uint64(off) + 1
@@ -57,9 +63,45 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	return s, nil
 }
 
+// recover makes the index and store agree after an unclean shutdown,
+// keeping the records both hold. Index entries past the store's records
+// are dropped, then store bytes past the last indexed record.
+func (s *segment) recover() error {
+	s.index.recover(s.store.size)
+	for s.index.size > 0 {
+		_, pos, err := s.index.Last()
+		if err != nil {
+			return err
+		}
+		end, err := s.store.recordEnd(pos)
+		if err == nil && end <= s.store.size {
+			if end == s.store.size {
+				return nil
+			}
+			return s.store.Truncate(end)
+		}
+		// The last record was only partly written
+		s.index.size -= entWidth
+	}
+	if s.store.size == 0 {
+		return nil
+	}
+	return s.store.Truncate(0)
+}
+
+// Append writes the record at the segment's next offset. Records that
+// arrive without an append time are stamped with the current time.
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
+	// Make sure the index has room before writing to the store
+	if s.index.size+entWidth > s.config.Segment.MaxIndexBytes {
+		return 0, api.ErrSegmentFull{BaseOffset: s.baseOffset}
+	}
+
 	cur := s.nextOffset
 	record.Offset = cur
+	if record.AppendTime == nil {
+		record.AppendTime = timestamppb.Now()
+	}
 	p, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
@@ -68,6 +110,12 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	if err != nil {
 		return 0, err
 	}
+	// Write the record through to the file before it's acknowledged so it
+	// survives the process being killed. Syncing it to disk is left to
+	// rolls, Sync and Close.
+	if err = s.store.Flush(); err != nil {
+		return 0, err
+	}
 
 	if err := s.index.Write(uint32(cur-s.baseOffset), pos); err != nil {
 		return 0, err
@@ -82,16 +130,78 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 		return nil, err
 	}
 	raw, err := s.store.Read(pos)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, api.ErrCorruptRecord{Offset: off}
+	}
 	if err != nil {
 		return nil, err
 	}
 	rec := &api.Record{}
 	if err := proto.Unmarshal(raw, rec); err != nil {
-		return nil, err
+		return nil, api.ErrCorruptRecord{Offset: off}
 	}
 	return rec, nil
 }
 
+// ReadBatch reads the contiguous run of records starting at off with a
+// single read of the store. The run ends at the segment's end or once
+// adding another record would exceed maxRecords or maxBytes, so it may be
+// empty. A zero limit means no limit. The returned size is the number of
+// store bytes the batch occupies.
+func (s *segment) ReadBatch(off, maxRecords, maxBytes uint64) (
+	[]*api.Record,
+	uint64,
+	error,
+) {
+	// Find the position of the first record
+	_, start, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Walk the index to find where the batch ends in the store
+	end := start
+	for cur := off; cur < s.nextOffset; cur++ {
+		next := s.store.size
+		if cur+1 < s.nextOffset {
+			if _, next, err = s.index.Read(int64(cur + 1 - s.baseOffset)); err != nil {
+				return nil, 0, err
+			}
+		}
+		n := cur - off + 1
+		if maxRecords > 0 && n > maxRecords ||
+			maxBytes > 0 && next-start > maxBytes {
+			break
+		}
+		end = next
+	}
+
+	// Read the whole batch at once and split it into records
+	b := make([]byte, end-start)
+	if _, err := s.store.ReadAt(b, int64(start)); err != nil {
+		return nil, 0, err
+	}
+	var records []*api.Record
+	for p := uint64(0); p < uint64(len(b)); {
+		corrupt := api.ErrCorruptRecord{Offset: off + uint64(len(records))}
+		if p+lenWidth > uint64(len(b)) {
+			return nil, 0, corrupt
+		}
+		size := enc.Uint64(b[p : p+lenWidth])
+		p += lenWidth
+		if size > uint64(len(b))-p {
+			return nil, 0, corrupt
+		}
+		rec := &api.Record{}
+		if err := proto.Unmarshal(b[p:p+size], rec); err != nil {
+			return nil, 0, corrupt
+		}
+		records = append(records, rec)
+		p += size
+	}
+	return records, end - start, nil
+}
+
 func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
@@ -105,9 +215,39 @@ func (s *segment) Remove() error {
 	return nil
 }
 
+// TruncateFrom drops the segment's records from off onward.
+func (s *segment) TruncateFrom(off uint64) error {
+	if off >= s.nextOffset {
+		return nil
+	}
+	if off < s.baseOffset {
+		off = s.baseOffset
+	}
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return err
+	}
+	if err = s.store.Truncate(pos); err != nil {
+		return err
+	}
+	s.index.Truncate(off - s.baseOffset)
+	s.nextOffset = off
+	return nil
+}
+
+// IsMaxed reports whether the store reached its max size or the index has
+// no room for another entry.
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+		s.index.size+entWidth > s.config.Segment.MaxIndexBytes
+}
+
+// Sync writes the segment's records through to disk
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
 }
 
 func (s *segment) Close() error {
@@ -1,7 +1,6 @@
 package log
 
 import (
-	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -35,11 +34,12 @@ func TestSegment(t *testing.T) {
 		got, err := s.Read(off)
 		require.NoError(t, err)
 		require.Equal(t, want.Value, got.Value)
+		require.NotNil(t, got.AppendTime)
 	}
 
 	// Should not be able to write because index is maxed
 	_, err = s.Append(want)
-	require.Error(t, io.EOF, err)
+	require.Equal(t, api.ErrSegmentFull{BaseOffset: 16}, err)
 	require.True(t, s.IsMaxed())
 
 	// Should be maxed if store is at max size
@@ -59,3 +59,32 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentCorruptRecord(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-corrupt-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.MaxStoreBytes = 1024
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// Overwrite the start of the record with garbage
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, lenWidth)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	_, err = s.Read(0)
+	require.Equal(t, api.ErrCorruptRecord{Offset: 0}, err)
+	_, _, err = s.ReadBatch(0, 0, 0)
+	require.Equal(t, api.ErrCorruptRecord{Offset: 0}, err)
+}
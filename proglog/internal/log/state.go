@@ -0,0 +1,233 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+// stateExt is the extension of the files the log snapshots its producer and
+// transaction state to, each named after the offset it's as of
+const stateExt = ".state"
+
+// state is the producer, transaction and topic state of a log as of an
+// offset. The
+// log snapshots it beside its segments as it rolls them and when it closes,
+// so the state survives segments being truncated and the log needn't read
+// every record to rebuild it when it opens.
+type state struct {
+	Producers       map[uint64][]producerState `json:"producers"`
+	NextTransaction uint64                     `json:"next_transaction"`
+	Open            map[uint64]openState       `json:"open"`
+	Aborted         []uint64                   `json:"aborted"`
+	Offsets         map[string]uint64          `json:"offsets"`
+	// MinInSyncReplicas is the topic's setting, zero before it's configured
+	MinInSyncReplicas uint64 `json:"min_insync_replicas,omitempty"`
+}
+
+type producerState struct {
+	Sequence uint64 `json:"sequence"`
+	Offset   uint64 `json:"offset"`
+}
+
+type openState struct {
+	First   uint64            `json:"first"`
+	Offsets []offsetCommitted `json:"offsets"`
+}
+
+type offsetCommitted struct {
+	Group  string `json:"group"`
+	Offset uint64 `json:"offset"`
+}
+
+func newState(p producers, t *transactions, topic *api.TopicConfig) *state {
+	s := &state{
+		Producers:       make(map[uint64][]producerState, len(p)),
+		NextTransaction: t.next,
+		Open:            make(map[uint64]openState, len(t.open)),
+		Offsets:         t.offsets,
+	}
+	for id, entries := range p {
+		for _, e := range entries {
+			s.Producers[id] = append(s.Producers[id], producerState{
+				Sequence: e.sequence,
+				Offset:   e.offset,
+			})
+		}
+	}
+	for id, txn := range t.open {
+		open := openState{First: txn.first}
+		for _, oc := range txn.offsets {
+			open.Offsets = append(open.Offsets, offsetCommitted{
+				Group:  oc.Group,
+				Offset: oc.Offset,
+			})
+		}
+		s.Open[id] = open
+	}
+	for id := range t.aborted {
+		s.Aborted = append(s.Aborted, id)
+	}
+	if topic != nil {
+		s.MinInSyncReplicas = topic.MinInsyncReplicas
+	}
+	return s
+}
+
+// restore returns the producer, transaction and topic state the snapshot
+// holds
+func (s *state) restore() (producers, *transactions, *api.TopicConfig) {
+	p := make(producers, len(s.Producers))
+	for id, entries := range s.Producers {
+		for _, e := range entries {
+			p[id] = append(p[id], producerEntry{
+				sequence: e.Sequence,
+				offset:   e.Offset,
+			})
+		}
+	}
+	t := newTransactions()
+	t.next = s.NextTransaction
+	for id, open := range s.Open {
+		txn := &transaction{first: open.First}
+		for _, oc := range open.Offsets {
+			txn.offsets = append(txn.offsets, &api.OffsetCommit{
+				Group:  oc.Group,
+				Offset: oc.Offset,
+			})
+		}
+		t.open[id] = txn
+	}
+	for _, id := range s.Aborted {
+		t.aborted[id] = struct{}{}
+	}
+	for group, off := range s.Offsets {
+		t.offsets[group] = off
+	}
+	var topic *api.TopicConfig
+	if s.MinInSyncReplicas != 0 {
+		topic = &api.TopicConfig{MinInsyncReplicas: s.MinInSyncReplicas}
+	}
+	return p, t, topic
+}
+
+// statePath returns the path of the state snapshot as of off
+func (l *Log) statePath(off uint64) string {
+	return path.Join(l.Dir, fmt.Sprintf("%d%s", off, stateExt))
+}
+
+// stateOffsets returns the offsets of the log's state snapshots, in order
+func (l *Log) stateOffsets() ([]uint64, error) {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var offs []uint64
+	for _, f := range files {
+		if path.Ext(f.Name()) != stateExt {
+			continue
+		}
+		offStr := strings.TrimSuffix(f.Name(), stateExt)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+	return offs, nil
+}
+
+// saveState snapshots the producer and transaction state as of the log's
+// next offset, then prunes the snapshots no longer needed
+func (l *Log) saveState() error {
+	b, err := json.Marshal(newState(l.producers, l.txns, l.topic))
+	if err != nil {
+		return err
+	}
+	// Write the snapshot whole or not at all
+	off := l.activeSegment.nextOffset
+	tmp := l.statePath(off) + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, l.statePath(off)); err != nil {
+		return err
+	}
+	return l.pruneStates()
+}
+
+// loadState returns the latest state snapshot at or before off and the
+// offset it's as of, removing the snapshots past off. Without one it
+// returns an empty state as of the log's lowest offset.
+func (l *Log) loadState(off uint64) (*state, uint64, error) {
+	offs, err := l.stateOffsets()
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := len(offs) - 1; i >= 0; i-- {
+		if offs[i] > off {
+			// The records it's as of were truncated
+			if err = os.Remove(l.statePath(offs[i])); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		b, err := ioutil.ReadFile(l.statePath(offs[i]))
+		if err != nil {
+			return nil, 0, err
+		}
+		s := &state{}
+		if err = json.Unmarshal(b, s); err != nil {
+			// Fall back on an older snapshot
+			continue
+		}
+		return s, offs[i], nil
+	}
+	return newState(make(producers), newTransactions(), nil),
+		l.segments[0].baseOffset,
+		nil
+}
+
+// pruneStates removes the state snapshots no longer needed: all but the
+// latest within each segment, which TruncateFrom restores from, and all but
+// the latest before the log's lowest offset, which holds the state of the
+// truncated records
+func (l *Log) pruneStates() error {
+	offs, err := l.stateOffsets()
+	if err != nil {
+		return err
+	}
+	// Snapshots are kept by the segment they're within, -1 being before
+	// the lowest offset
+	latest := make(map[int]uint64)
+	for _, off := range offs {
+		seg := -1
+		for i, s := range l.segments {
+			if off >= s.baseOffset {
+				seg = i
+			}
+		}
+		latest[seg] = off
+	}
+	for _, off := range offs {
+		keep := false
+		for _, kept := range latest {
+			keep = keep || off == kept
+		}
+		if keep {
+			continue
+		}
+		if err = os.Remove(l.statePath(off)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"io"
 	"os"
 	"sync"
 )
@@ -70,8 +71,12 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 		return nil, err
 	}
 
-	// Read record from file
-	b := make([]byte, enc.Uint64(size))
+	// Read record from file, failing on sizes past the end of the store
+	n := enc.Uint64(size)
+	if n > s.size-pos-lenWidth {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
 	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
 		return nil, err
 	}
@@ -90,14 +95,63 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
-func (s *store) Close() error {
+// recordEnd returns the position just past the record at pos
+func (s *store) recordEnd(pos uint64) (uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+	size := make([]byte, lenWidth)
+	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+		return 0, err
+	}
+	return pos + lenWidth + enc.Uint64(size), nil
+}
 
-	// Flush buffer before closing
+// Truncate drops the store's contents from pos onward
+func (s *store) Truncate(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if err := s.buf.Flush(); err != nil {
 		return err
 	}
+	if err := s.File.Truncate(int64(pos)); err != nil {
+		return err
+	}
+	s.size = pos
+	return nil
+}
+
+// Flush writes the buffered records through to the file
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+// Sync flushes the buffer and writes the store through to disk
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sync()
+}
+
+func (s *store) sync() error {
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+func (s *store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Flush buffer and sync it to disk before closing
+	if err := s.sync(); err != nil {
+		return err
+	}
 
 	return s.File.Close()
 }
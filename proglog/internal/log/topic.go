@@ -0,0 +1,50 @@
+package log
+
+import (
+	"fmt"
+
+	api "github.com/mstreet3/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultMinInSyncReplicas is the topic's min_insync_replicas until a
+// TOPIC_CONFIG marker sets it
+const defaultMinInSyncReplicas = 1
+
+// checkTopicConfig validates a TOPIC_CONFIG marker before it is appended
+func checkTopicConfig(record *api.Record) error {
+	if record.TransactionId != 0 {
+		return fmt.Errorf(
+			"topic config added to transaction %d",
+			record.TransactionId,
+		)
+	}
+	c := &api.TopicConfig{}
+	if err := proto.Unmarshal(record.Value, c); err != nil {
+		return err
+	}
+	return validateTopicConfig(c)
+}
+
+// validateTopicConfig returns an error unless every setting of the topic
+// config is in range
+func validateTopicConfig(c *api.TopicConfig) error {
+	if c.MinInsyncReplicas < 1 {
+		return fmt.Errorf(
+			"min_insync_replicas is %d, it must be at least 1",
+			c.MinInsyncReplicas,
+		)
+	}
+	return nil
+}
+
+// TopicConfig returns the settings of the log's topic as of the last
+// TOPIC_CONFIG marker appended, or the defaults before one is.
+func (l *Log) TopicConfig() *api.TopicConfig {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.topic == nil {
+		return &api.TopicConfig{MinInsyncReplicas: defaultMinInSyncReplicas}
+	}
+	return proto.Clone(l.topic).(*api.TopicConfig)
+}
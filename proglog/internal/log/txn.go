@@ -0,0 +1,105 @@
+package log
+
+import (
+	api "github.com/mstreet3/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// transaction is a transaction that has begun but not yet ended
+type transaction struct {
+	first   uint64
+	offsets []*api.OffsetCommit
+}
+
+// transactions tracks the state built up by the transaction markers in the
+// log: which transactions are open or were aborted and the offsets consumer
+// groups committed through transactions.
+type transactions struct {
+	next    uint64
+	open    map[uint64]*transaction
+	aborted map[uint64]struct{}
+	offsets map[string]uint64
+}
+
+func newTransactions() *transactions {
+	return &transactions{
+		next:    1,
+		open:    make(map[uint64]*transaction),
+		aborted: make(map[uint64]struct{}),
+		offsets: make(map[string]uint64),
+	}
+}
+
+// Check validates a record before it is appended. BEGIN markers are given
+// the next transaction id, every other transactional record must belong to
+// an open transaction.
+func (t *transactions) Check(record *api.Record) error {
+	if record.Control == api.Record_BEGIN {
+		record.TransactionId = t.next
+		return nil
+	}
+	if record.TransactionId == 0 && record.Control == api.Record_DATA {
+		return nil
+	}
+	if _, ok := t.open[record.TransactionId]; !ok {
+		return api.ErrTransactionNotOpen{TransactionId: record.TransactionId}
+	}
+	if record.Control == api.Record_OFFSET_COMMIT {
+		return proto.Unmarshal(record.Value, &api.OffsetCommit{})
+	}
+	return nil
+}
+
+// Apply updates the transaction state with an appended record.
+func (t *transactions) Apply(record *api.Record) {
+	id := record.TransactionId
+	switch record.Control {
+	case api.Record_BEGIN:
+		t.open[id] = &transaction{first: record.Offset}
+		if id >= t.next {
+			t.next = id + 1
+		}
+	case api.Record_OFFSET_COMMIT:
+		txn, ok := t.open[id]
+		if !ok {
+			return
+		}
+		oc := &api.OffsetCommit{}
+		if err := proto.Unmarshal(record.Value, oc); err == nil {
+			txn.offsets = append(txn.offsets, oc)
+		}
+	case api.Record_COMMIT:
+		if txn, ok := t.open[id]; ok {
+			for _, oc := range txn.offsets {
+				t.offsets[oc.Group] = oc.Offset
+			}
+		}
+		delete(t.open, id)
+	case api.Record_ABORT:
+		t.aborted[id] = struct{}{}
+		delete(t.open, id)
+	}
+}
+
+// FirstOpen returns the offset of the earliest open transaction's BEGIN
+// marker, if any transaction is open.
+func (t *transactions) FirstOpen() (uint64, bool) {
+	var first uint64
+	found := false
+	for _, txn := range t.open {
+		if !found || txn.first < first {
+			first, found = txn.first, true
+		}
+	}
+	return first, found
+}
+
+// Visible reports whether a record below the last stable offset is shown
+// to READ_COMMITTED readers.
+func (t *transactions) Visible(record *api.Record) bool {
+	if record.Control != api.Record_DATA {
+		return false
+	}
+	_, aborted := t.aborted[record.TransactionId]
+	return !aborted
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// logCollector reads a log's statistics when it's scraped, so the metrics
+// are never stale and the log pays nothing between scrapes
+type logCollector struct {
+	log           StatsSource
+	segments      *prometheus.Desc
+	activeBytes   *prometheus.Desc
+	lowestOffset  *prometheus.Desc
+	highestOffset *prometheus.Desc
+	appended      *prometheus.Desc
+	lag           *prometheus.Desc
+}
+
+func newLogCollector(name string, l StatsSource) *logCollector {
+	labels := prometheus.Labels{"log": name}
+	desc := func(name, help string, variableLabels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(namespace+"_"+name, help, variableLabels, labels)
+	}
+	return &logCollector{
+		log:           l,
+		segments:      desc("log_segments", "Number of segments in the log."),
+		activeBytes:   desc("log_active_segment_bytes", "Size of the active segment's store."),
+		lowestOffset:  desc("log_lowest_offset", "Offset of the oldest record in the log."),
+		highestOffset: desc("log_highest_offset", "Offset of the newest record in the log."),
+		appended:      desc("log_appended_bytes_total", "Bytes appended since the log was opened."),
+		lag:           desc("consumer_group_lag", "Records appended past the group's committed offset.", "group"),
+	}
+}
+
+func (c *logCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.segments
+	ch <- c.activeBytes
+	ch <- c.lowestOffset
+	ch <- c.highestOffset
+	ch <- c.appended
+	ch <- c.lag
+}
+
+func (c *logCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.log.Stats()
+	gauge := func(desc *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v), labels...)
+	}
+	gauge(c.segments, uint64(stats.Segments))
+	gauge(c.activeBytes, stats.ActiveSegmentBytes)
+	gauge(c.lowestOffset, stats.LowestOffset)
+	// An empty log has no highest offset
+	if stats.NextOffset > stats.LowestOffset {
+		gauge(c.highestOffset, stats.NextOffset-1)
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.appended,
+		prometheus.CounterValue,
+		float64(stats.AppendedBytes),
+	)
+	for group, committed := range stats.CommittedOffsets {
+		var lag uint64
+		if committed < stats.NextOffset {
+			lag = stats.NextOffset - committed
+		}
+		gauge(c.lag, lag, group)
+	}
+}
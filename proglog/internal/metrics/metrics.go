@@ -0,0 +1,190 @@
+// Package metrics collects Prometheus metrics from the log and the servers
+// in front of it.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/mstreet3/proglog/internal/log"
+)
+
+const namespace = "proglog"
+
+// StatsSource is a log whose statistics are collected at every scrape.
+type StatsSource interface {
+	Stats() log.Stats
+}
+
+// LagSource is a follower whose lag behind its leader is read at every
+// scrape.
+type LagSource interface {
+	Lag() uint64
+}
+
+// Metrics holds the metrics of one server and the registry serving them.
+type Metrics struct {
+	registry       *prometheus.Registry
+	rpcs           *prometheus.CounterVec
+	rpcDuration    *prometheus.HistogramVec
+	streamMessages *prometheus.CounterVec
+	httpRequests   *prometheus.CounterVec
+	httpDuration   *prometheus.HistogramVec
+	syncDuration   prometheus.Histogram
+}
+
+// New creates the metrics in their own registry along with the Go runtime
+// and process metrics.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		rpcs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "grpc",
+			Name:      "requests_total",
+			Help:      "gRPC requests handled, by method and status code.",
+		}, []string{"method", "code"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "grpc",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of unary gRPC requests, by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		streamMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "grpc",
+			Name:      "stream_messages_total",
+			Help:      "Messages received and sent on gRPC streams, by method.",
+		}, []string{"method", "direction"}),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "HTTP requests handled, by method and status code.",
+		}, []string{"method", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of HTTP requests, by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		syncDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "log",
+			Name:      "sync_duration_seconds",
+			Help:      "Latency of syncing segments to disk.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.rpcs,
+		m.rpcDuration,
+		m.streamMessages,
+		m.httpRequests,
+		m.httpDuration,
+		m.syncDuration,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// AddLog collects the statistics of the log named name.
+func (m *Metrics) AddLog(name string, l StatsSource) error {
+	return m.registry.Register(newLogCollector(name, l))
+}
+
+// AddReplicator collects the lag of the replica of the log named name.
+func (m *Metrics) AddReplicator(name string, r LagSource) error {
+	return m.registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   "replication",
+		Name:        "lag_records",
+		Help:        "Records the replica is behind its leader.",
+		ConstLabels: prometheus.Labels{"log": name},
+	}, func() float64 {
+		return float64(r.Lag())
+	}))
+}
+
+// ObserveSync records how long syncing a segment took. It's meant to be
+// the log's Config.OnSync.
+func (m *Metrics) ObserveSync(d time.Duration) {
+	m.syncDuration.Observe(d.Seconds())
+}
+
+// UnaryServerInterceptor counts and times unary requests.
+func (m *Metrics) UnaryServerInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	method := path.Base(info.FullMethod)
+	start := time.Now()
+	res, err := handler(ctx, req)
+	m.rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	m.rpcs.WithLabelValues(method, status.Code(err).String()).Inc()
+	return res, err
+}
+
+// StreamServerInterceptor counts streams and the messages on them.
+func (m *Metrics) StreamServerInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	method := path.Base(info.FullMethod)
+	err := handler(srv, &serverStream{
+		ServerStream: ss,
+		received:     m.streamMessages.WithLabelValues(method, "received"),
+		sent:         m.streamMessages.WithLabelValues(method, "sent"),
+	})
+	m.rpcs.WithLabelValues(method, status.Code(err).String()).Inc()
+	return err
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	received prometheus.Counter
+	sent     prometheus.Counter
+}
+
+func (s *serverStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.received.Inc()
+	}
+	return err
+}
+
+func (s *serverStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent.Inc()
+	}
+	return err
+}
+
+// InstrumentHTTP counts and times the requests served by next.
+func (m *Metrics) InstrumentHTTP(next http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerCounter(
+		m.httpRequests,
+		promhttp.InstrumentHandlerDuration(m.httpDuration, next),
+	)
+}
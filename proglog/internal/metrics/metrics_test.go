@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/mstreet3/proglog/internal/log"
+)
+
+type stats log.Stats
+
+func (s stats) Stats() log.Stats { return log.Stats(s) }
+
+type lag uint64
+
+func (l lag) Lag() uint64 { return uint64(l) }
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	require.NoError(t, m.AddLog("default", stats{
+		Segments:           2,
+		ActiveSegmentBytes: 128,
+		LowestOffset:       0,
+		NextOffset:         10,
+		AppendedBytes:      512,
+		CommittedOffsets:   map[string]uint64{"g": 4},
+	}))
+	require.NoError(t, m.AddReplicator("default", lag(3)))
+	m.ObserveSync(2 * time.Millisecond)
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/log.v1.Log/Produce"}
+	ok := func(context.Context, interface{}) (interface{}, error) { return nil, nil }
+	_, err := m.UnaryServerInterceptor(context.Background(), nil, info, ok)
+	require.NoError(t, err)
+	info.FullMethod = "/log.v1.Log/Consume"
+	notFound := func(context.Context, interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "offset out of range")
+	}
+	_, err = m.UnaryServerInterceptor(context.Background(), nil, info, notFound)
+	require.Error(t, err)
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(w.Body)
+	require.NoError(t, err)
+	for _, line := range []string{
+		`proglog_log_segments{log="default"} 2`,
+		`proglog_log_active_segment_bytes{log="default"} 128`,
+		`proglog_log_lowest_offset{log="default"} 0`,
+		`proglog_log_highest_offset{log="default"} 9`,
+		`proglog_log_appended_bytes_total{log="default"} 512`,
+		`proglog_consumer_group_lag{group="g",log="default"} 6`,
+		`proglog_replication_lag_records{log="default"} 3`,
+		`proglog_log_sync_duration_seconds_count 1`,
+		`proglog_grpc_requests_total{code="OK",method="Produce"} 1`,
+		`proglog_grpc_requests_total{code="NotFound",method="Consume"} 1`,
+		`proglog_grpc_request_duration_seconds_count{method="Produce"} 1`,
+	} {
+		require.Contains(t, string(body), line)
+	}
+}
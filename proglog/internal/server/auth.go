@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Authorizer decides whether a subject may take an action on an object.
+type Authorizer interface {
+	Authorize(subject, object, action string) error
+}
+
+const (
+	// objectWildcard is the object of admin actions, which change the
+	// cluster serving every topic
+	objectWildcard = "*"
+	produceAction  = "produce"
+	consumeAction  = "consume"
+	adminAction    = "admin"
+)
+
+type subjectContextKey struct{}
+
+// authorize checks the request's subject, the common name of its client
+// certificate or the id of its HTTP API key, may take the action on the
+// server's topic, or on every topic for admin actions. Every action is
+// allowed when no Authorizer is set.
+func (s *grpcServer) authorize(ctx context.Context, action string) error {
+	if s.authorizer == nil {
+		return nil
+	}
+	object := s.topic()
+	if action == adminAction {
+		object = objectWildcard
+	}
+	return s.authorizer.Authorize(subject(ctx), object, action)
+}
+
+// authenticate stores the common name of the client's verified certificate
+// in the context as the request's subject
+func authenticate(ctx context.Context) (context.Context, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx, status.New(
+			codes.Unknown,
+			"couldn't find peer info",
+		).Err()
+	}
+	if p.AuthInfo == nil {
+		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 ||
+		len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	}
+	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+	requestInfoFrom(ctx).setSubject(subject)
+	return context.WithValue(ctx, subjectContextKey{}, subject), nil
+}
+
+func subject(ctx context.Context) string {
+	subject, _ := ctx.Value(subjectContextKey{}).(string)
+	return subject
+}
+
+func authenticateUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ctx, err := authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func authenticateStreamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ctx, err := authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+// serverStream overrides the context of a grpc.ServerStream
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+// Cluster changes the configuration of a replicated log's cluster, so that
+// servers can be rolled without downtime, and describes its state.
+type Cluster interface {
+	AddServer(id, addr string, suffrage api.Suffrage) error
+	PromoteServer(id string) error
+	DemoteServer(id string) error
+	RemoveServer(id string) error
+	// TransferLeadership hands the leadership to the server with the id,
+	// or any other when it's empty
+	TransferLeadership(id string) error
+	GetClusterState() (*api.GetClusterStateResponse, error)
+}
+
+// AddServer adds a server to the cluster.
+func (s *grpcServer) AddServer(ctx context.Context, req *api.AddServerRequest) (
+	*api.AddServerResponse,
+	error,
+) {
+	if err := s.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if req.Id == "" {
+		return nil, errMissingField("id")
+	}
+	if req.RpcAddr == "" {
+		return nil, errMissingField("rpc_addr")
+	}
+	err := s.Cluster.AddServer(req.Id, req.RpcAddr, req.Suffrage)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AddServerResponse{}, nil
+}
+
+// PromoteServer makes a server of the cluster a voter.
+func (s *grpcServer) PromoteServer(
+	ctx context.Context,
+	req *api.PromoteServerRequest,
+) (*api.PromoteServerResponse, error) {
+	if err := s.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if req.Id == "" {
+		return nil, errMissingField("id")
+	}
+	if err := s.Cluster.PromoteServer(req.Id); err != nil {
+		return nil, err
+	}
+	return &api.PromoteServerResponse{}, nil
+}
+
+// DemoteServer makes a server of the cluster a nonvoter.
+func (s *grpcServer) DemoteServer(
+	ctx context.Context,
+	req *api.DemoteServerRequest,
+) (*api.DemoteServerResponse, error) {
+	if err := s.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if req.Id == "" {
+		return nil, errMissingField("id")
+	}
+	if err := s.Cluster.DemoteServer(req.Id); err != nil {
+		return nil, err
+	}
+	return &api.DemoteServerResponse{}, nil
+}
+
+// RemoveServer removes a server from the cluster.
+func (s *grpcServer) RemoveServer(
+	ctx context.Context,
+	req *api.RemoveServerRequest,
+) (*api.RemoveServerResponse, error) {
+	if err := s.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if req.Id == "" {
+		return nil, errMissingField("id")
+	}
+	if err := s.Cluster.RemoveServer(req.Id); err != nil {
+		return nil, err
+	}
+	return &api.RemoveServerResponse{}, nil
+}
+
+// TransferLeadership hands the cluster's leadership to another server and
+// returns once it has taken over.
+func (s *grpcServer) TransferLeadership(
+	ctx context.Context,
+	req *api.TransferLeadershipRequest,
+) (*api.TransferLeadershipResponse, error) {
+	if err := s.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.Cluster.TransferLeadership(req.Id); err != nil {
+		return nil, err
+	}
+	return &api.TransferLeadershipResponse{}, nil
+}
+
+// GetClusterState describes the cluster as the server sees it. Any server
+// of the cluster can answer, not only its leader.
+func (s *grpcServer) GetClusterState(
+	ctx context.Context,
+	req *api.GetClusterStateRequest,
+) (*api.GetClusterStateResponse, error) {
+	if err := s.authorize(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	if s.Cluster == nil {
+		return nil, errNotClustered()
+	}
+	return s.Cluster.GetClusterState()
+}
+
+// checkAdmin authorizes a change to the cluster, which only its leader can
+// make. Other servers refuse it with api.ErrNotLeader, naming the leader.
+func (s *grpcServer) checkAdmin(ctx context.Context) error {
+	if err := s.authorize(ctx, adminAction); err != nil {
+		return err
+	}
+	if s.Cluster == nil {
+		return errNotClustered()
+	}
+	if s.Leader == nil || s.Leader.IsLeader() {
+		return nil
+	}
+	addr := s.Leader.LeaderAddr()
+	if addr == "" {
+		return errNoLeader()
+	}
+	return api.ErrNotLeader{LeaderAddr: addr}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	rpccode "google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrorResponse is the envelope of every error the HTTP API responds with.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeMessage responds with m in the API's JSON encoding
+func writeMessage(w http.ResponseWriter, code int, m proto.Message) {
+	b, err := jsonMarshaler.Marshal(m)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// writeError responds with err in an ErrorResponse envelope, with the HTTP
+// status and code matching its gRPC code
+func writeError(w http.ResponseWriter, err error) {
+	res := errorResponse(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Error.Status)
+	json.NewEncoder(w).Encode(res)
+}
+
+func errorResponse(err error) ErrorResponse {
+	st := status.Convert(toStatus(err))
+	return ErrorResponse{Error: ErrorBody{
+		Status:  httpStatus(err),
+		Code:    rpccode.Code(st.Code()).String(),
+		Message: st.Message(),
+	}}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// toStatus gives errors without a gRPC status a proper code so that
+// clients never see codes.Unknown. Errors such as the api package's typed
+// errors already carry a status and pass through unchanged.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch err {
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case raft.ErrNotLeader, raft.ErrLeadershipLost,
+		raft.ErrLeadershipTransferInProgress:
+		// The leader is changing under a replicated log
+		return errNoLeader()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func errorUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	res, err := handler(ctx, req)
+	return res, toStatus(err)
+}
+
+func errorStreamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return toStatus(handler(srv, ss))
+}
+
+// errMissingField rejects a request that left a required field unset
+func errMissingField(field string) error {
+	return errBadRequest("missing "+field, field, "The field is required")
+}
+
+// errInvalidField rejects a request that set a field to a value the server
+// won't accept, the description saying why
+func errInvalidField(field, description string) error {
+	return errBadRequest("invalid "+field, field, description)
+}
+
+// errBadRequest rejects a request with the message, detailing the field
+// that's wrong with it
+func errBadRequest(msg, field, description string) error {
+	st := status.New(codes.InvalidArgument, msg)
+	std, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field:       field,
+			Description: description,
+		}},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return std.Err()
+}
+
+// errShuttingDown refuses requests once the server is draining. Clients
+// should retry against another server or after a restart.
+func errShuttingDown() error {
+	st := status.New(codes.Unavailable, "server is shutting down")
+	std, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(time.Second),
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return std.Err()
+}
+
+// errNotClustered is returned by GetServers from a server that isn't part
+// of a cluster, leaving clients to send every request to it
+func errNotClustered() error {
+	return status.Error(codes.FailedPrecondition, "server isn't clustered")
+}
+
+// errNoLeader refuses requests only a replicated log's leader can serve
+// while its cluster has no leader or the leader is changing, e.g. during an
+// election. Clients should retry shortly.
+func errNoLeader() error {
+	st := status.New(codes.Unavailable, "no known leader")
+	std, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(time.Second),
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return std.Err()
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+// forwardedKey marks produce and transaction requests a follower has
+// forwarded in gRPC metadata. A server that isn't the leader redirects them rather than
+// forwarding them again, so they can't bounce between servers that
+// disagree on who leads.
+const forwardedKey = "x-proglog-forwarded"
+
+// forwarder keeps the connection produce and transaction requests are
+// forwarded over, redialing whenever the leader changes
+type forwarder struct {
+	mu   sync.Mutex
+	addr string
+	cc   *grpc.ClientConn
+}
+
+// client returns a client of the leader at addr
+func (f *forwarder) client(addr string, opts []grpc.DialOption) (
+	api.LogClient,
+	error,
+) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cc != nil && f.addr == addr {
+		return api.NewLogClient(f.cc), nil
+	}
+	if f.cc != nil {
+		// Requests still in flight to the old leader fail, as they would
+		// have anyway
+		f.cc.Close()
+		f.cc = nil
+	}
+	cc, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	f.addr, f.cc = addr, cc
+	return api.NewLogClient(cc), nil
+}
+
+func (f *forwarder) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cc == nil {
+		return nil
+	}
+	err := f.cc.Close()
+	f.cc = nil
+	return err
+}
+
+// Close closes the connection to the leader produce and transaction
+// requests were forwarded over, once the servers of the repository have
+// stopped.
+func (c *LogRepository) Close() error {
+	return c.forwarder.close()
+}
+
+// follower reports whether the repository's log is replicated and this
+// server isn't its leader, so produce and transaction requests go to the
+// leader
+func (s *grpcServer) follower() bool {
+	return s.Leader != nil && !s.Leader.IsLeader()
+}
+
+// leaderClient returns a client of the leader to forward the request of a
+// client already authorized here to, authenticated with the
+// LeaderDialOptions, and the context to forward it in. When
+// RedirectProduce is set it returns api.ErrNotLeader instead, leaving the
+// client to retry against the leader.
+func (s *grpcServer) leaderClient(ctx context.Context) (
+	api.LogClient,
+	context.Context,
+	error,
+) {
+	addr := s.Leader.LeaderAddr()
+	if addr == "" {
+		return nil, nil, errNoLeader()
+	}
+	if s.RedirectProduce || forwarded(ctx) {
+		return nil, nil, api.ErrNotLeader{LeaderAddr: addr}
+	}
+	client, err := s.forwarder.client(addr, s.LeaderDialOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The leader logs the request under the same id
+	md := metadata.Pairs(forwardedKey, "true")
+	if ri := requestInfoFrom(ctx); ri != nil {
+		md.Set(requestIDKey, ri.id)
+	}
+	return client, metadata.NewOutgoingContext(ctx, md), nil
+}
+
+// forwardProduce sends the produce request on to the leader and returns
+// the leader's response
+func (s *grpcServer) forwardProduce(
+	ctx context.Context,
+	req *api.ProduceRequest,
+) (*api.ProduceResponse, error) {
+	client, ctx, err := s.leaderClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.Produce(ctx, req)
+}
+
+// forwarded reports whether a follower forwarded the request
+func forwarded(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	return ok && len(md.Get(forwardedKey)) > 0
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/mstreet3/proglog/api/v1"
+	"github.com/mstreet3/proglog/internal/log"
+)
+
+// setupForwardTest serves a leader's own log and returns a client of a
+// follower forwarding to it
+func setupForwardTest(t *testing.T) (
+	client api.LogClient,
+	repo *LogRepository,
+	leaderLog *log.Log,
+	follower *leader,
+	teardown func(),
+) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "forward-test")
+	require.NoError(t, err)
+	leaderLog, err = log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := NewGRPCServer(&LogRepository{CommitLog: leaderLog})
+	require.NoError(t, err)
+	go srv.Serve(ln)
+
+	follower = &leader{addr: ln.Addr().String()}
+	client, _, repo, teardownFollower := setupTest(t, func(repo *LogRepository) {
+		repo.Leader = follower
+		repo.LeaderDialOptions = []grpc.DialOption{grpc.WithInsecure()}
+	})
+	return client, repo, leaderLog, follower, func() {
+		teardownFollower()
+		repo.Close()
+		srv.Stop()
+		leaderLog.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestForwardProduce(t *testing.T) {
+	ctx := context.Background()
+	client, repo, leaderLog, leader, teardown := setupForwardTest(t)
+	defer teardown()
+
+	// Produces to the follower are appended to the leader's log
+	res, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("first")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+
+	stream, err := client.ProduceStream(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("second")},
+	})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+
+	for off, want := range []string{"first", "second"} {
+		record, err := leaderLog.Read(ctx, uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+	}
+	_, err = repo.CommitLog.Read(ctx, 0)
+	require.Error(t, err)
+
+	// Redirecting followers name the leader instead
+	repo.RedirectProduce = true
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("third")},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	addr, ok := api.LeaderAddr(err)
+	require.True(t, ok)
+	require.Equal(t, leader.addr, addr)
+
+	// Without a leader produces are worth retrying
+	leader.addr = ""
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("third")},
+	})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestForwardTxn(t *testing.T) {
+	ctx := context.Background()
+	client, repo, leaderLog, leader, teardown := setupForwardTest(t)
+	defer teardown()
+
+	// Transactions run through a follower are run on the leader
+	begin, err := client.BeginTxn(ctx, &api.BeginTxnRequest{})
+	require.NoError(t, err)
+	_, err = client.AddToTxn(ctx, &api.AddToTxnRequest{
+		TransactionId: begin.TransactionId,
+		Records:       []*api.Record{{Value: []byte("first")}},
+	})
+	require.NoError(t, err)
+	_, err = client.CommitTxn(ctx, &api.CommitTxnRequest{
+		TransactionId: begin.TransactionId,
+	})
+	require.NoError(t, err)
+	records, err := leaderLog.ReadBatchCommitted(ctx, 0, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "first", string(records[0].Value))
+	_, err = repo.CommitLog.Read(ctx, 0)
+	require.Error(t, err)
+
+	begin, err = client.BeginTxn(ctx, &api.BeginTxnRequest{})
+	require.NoError(t, err)
+	_, err = client.AbortTxn(ctx, &api.AbortTxnRequest{
+		TransactionId: begin.TransactionId,
+	})
+	require.NoError(t, err)
+	_, err = leaderLog.Read(ctx, 4)
+	require.NoError(t, err)
+
+	// Redirecting followers name the leader instead
+	repo.RedirectProduce = true
+	_, err = client.BeginTxn(ctx, &api.BeginTxnRequest{})
+	addr, ok := api.LeaderAddr(err)
+	require.True(t, ok)
+	require.Equal(t, leader.addr, addr)
+}
+
+// leader is a follower's view of its cluster's leader
+type leader struct {
+	addr string
+}
+
+func (l *leader) IsLeader() bool {
+	return false
+}
+
+func (l *leader) LeaderAddr() string {
+	return l.addr
+}
@@ -1,114 +1,275 @@
 package server
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
-)
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
 
-type httpServer struct {
-	Log *Log
-}
+	api "github.com/mstreet3/proglog/api/v1"
+)
 
-func newHTTPServer() *httpServer {
-	return &httpServer{
-		Log: NewLog(),
-	}
+// KeyStore authenticates the API keys of HTTP requests and the scopes
+// they were granted.
+type KeyStore interface {
+	Authenticate(key string) (id string, err error)
+	Allowed(id, scope string) bool
 }
 
-type ProduceRequest struct {
-	Record Record `json:"record"`
-}
-type ProduceResponse struct {
-	Offset uint64 `json:"offset"`
-}
-type ConsumeRequest struct {
-	Offset uint64 `json:"offset"`
-}
-type ConsumeResponse struct {
-	Recrod Record `json:"record"`
+// httpServer serves the log over HTTP through a grpcServer, so requests
+// are handled, authorized and encoded exactly as they are over gRPC
+type httpServer struct {
+	srv  *grpcServer
+	Keys KeyStore
 }
 
-func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
-	/* unmarshall the request into a ProduceRequest struct */
-	var req ProduceRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+func newHTTPServer(c *LogRepository, keys KeyStore) (*httpServer, error) {
+	srv, err := newgrpcServer(c)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return nil, err
 	}
+	srv.authorizer = nil
+	if keys != nil {
+		srv.authorizer = keyAuthorizer{keys}
+	}
+	return &httpServer{
+		srv:  srv,
+		Keys: keys,
+	}, nil
+}
 
-	/* append the struct to the server in-memory log */
-	off, err := s.Log.Append(req.Record)
+func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
+	/* unmarshall the request into a ProduceRequest */
+	var req api.ProduceRequest
+	err := jsonMarshaler.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, status.Error(codes.InvalidArgument, err.Error()))
 		return
 	}
 
-	/* prepare the response */
-	res := ProduceResponse{Offset: off}
-	err = json.NewEncoder(w).Encode(res)
+	/* append the record to the commit log */
+	info := requestInfoFrom(r.Context())
+	info.observe(&req)
+	res, err := s.srv.Produce(r.Context(), &req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	info.observe(res)
+	writeMessage(w, http.StatusOK, res)
 }
 
 func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
-	/* unmarshall the request into a ConsumeRequest struct */
-	var req ConsumeRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	/* unmarshall the request into a ConsumeRequest */
+	var req api.ConsumeRequest
+	err := jsonMarshaler.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, status.Error(codes.InvalidArgument, err.Error()))
 		return
 	}
 
 	/* attempt to fetch a record by the offset */
-	rec, err := s.Log.Read(req.Offset)
-	if err == ErrOffsetNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	info := requestInfoFrom(r.Context())
+	info.observe(&req)
+	res, err := s.srv.Consume(r.Context(), &req)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
+	info.observe(res)
+	writeMessage(w, http.StatusOK, res)
+}
 
+// NewHTTPServer creates the HTTP JSON server for the repository's commit
+// log, which it may share with the gRPC server. The REST routes under
+// /v1/topics/{topic} are transcoded from log.proto's HTTP annotations and
+// served by the same implementation as gRPC, next to the record streams
+// and the original JSON routes on "/". When keys is not nil every request
+// must carry an API key as a bearer token with the scope of its route.
+func NewHTTPServer(addr string, c *LogRepository, keys KeyStore) (
+	*http.Server,
+	error,
+) {
+	httpsrv, err := newHTTPServer(c, keys)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-
-	/* marshall response */
-	res := ConsumeResponse{Recrod: rec}
-	err = json.NewEncoder(w).Encode(res)
+	gateway := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, jsonMarshaler),
+		runtime.WithForwardResponseOption(httpsrv.forwardResponse),
+		runtime.WithProtoErrorHandler(func(
+			_ context.Context,
+			_ *runtime.ServeMux,
+			_ runtime.Marshaler,
+			w http.ResponseWriter,
+			_ *http.Request,
+			err error,
+		) {
+			if err == runtime.ErrUnknownURI {
+				err = status.Error(codes.NotFound, http.StatusText(http.StatusNotFound))
+			}
+			msg := status.Convert(err).Message()
+			if m := typeMismatch.FindStringSubmatch(msg); m != nil {
+				err = status.Error(codes.InvalidArgument, "invalid "+m[1])
+			}
+			writeError(w, err)
+		}),
+	)
+	err = api.RegisterLogHandlerServer(context.Background(), gateway, httpsrv.srv)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-}
-
-func NewHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
 	r := mux.NewRouter()
 	r.HandleFunc("/", httpsrv.handleProduce).Methods("POST")
 	r.HandleFunc("/", httpsrv.handleConsume).Methods("GET")
-	r.Use(logging)
+	r.HandleFunc("/v1/topics/{topic}/stream", httpsrv.handleSSE).Methods("GET")
+	r.HandleFunc("/v1/topics/{topic}/ws", httpsrv.handleWebSocket).Methods("GET")
+	r.PathPrefix("/v1/topics/{topic}/").Handler(checkQuery(gateway))
+	r.PathPrefix("/").Handler(checkQuery(gateway))
+	r.Use(httpsrv.logging)
+	r.Use(httpsrv.authenticate)
 	return &http.Server{
 		Addr:    addr,
 		Handler: r,
-	}
+	}, nil
 }
 
-func logging(next http.Handler) http.Handler {
+// typeMismatch matches the gateway's errors for path parameters that don't
+// parse, capturing the parameter's name
+var typeMismatch = regexp.MustCompile(`^type mismatch, parameter: ([\w.]+),`)
+
+// uintQueryParams are the unsigned integer query parameters of the REST
+// routes, including their aliases
+var uintQueryParams = []string{"offset", "max_records", "max_bytes", "from", "limit"}
+
+// queryAliases maps the query parameters range reads took before the REST
+// routes were transcoded to the parameters they're now named
+var queryAliases = map[string]string{
+	"from":  "offset",
+	"limit": "max_records",
+}
+
+// checkQuery responds 400 Bad Request naming the first unsigned integer
+// query parameter that doesn't parse, as the gateway's own errors don't say
+// which parameter was invalid. Aliased parameters are renamed unless the
+// request also sets the parameter they alias.
+func checkQuery(next http.Handler) http.Handler {
 	h := func(w http.ResponseWriter, r *http.Request) {
-		log.Printf(
-			"[%s] %s %s %s\n",
-			r.Method,
-			r.Host,
-			r.URL.Path,
-			r.URL.RawQuery,
-		)
+		query := r.URL.Query()
+		for _, name := range uintQueryParams {
+			for _, v := range query[name] {
+				if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+					writeError(w, status.Error(codes.InvalidArgument, "invalid "+name))
+					return
+				}
+			}
+		}
+		for alias, name := range queryAliases {
+			if _, ok := query[alias]; !ok {
+				continue
+			}
+			if _, ok := query[name]; !ok {
+				query[name] = query[alias]
+			}
+			delete(query, alias)
+			r.URL.RawQuery = query.Encode()
+		}
 		next.ServeHTTP(w, r)
 	}
 	return http.HandlerFunc(h)
 }
+
+// forwardResponse responds 201 Created to appends, pointing at the record.
+// The gateway passes responses as protoiface.MessageV1.
+func (s *httpServer) forwardResponse(
+	ctx context.Context,
+	w http.ResponseWriter,
+	m protoiface.MessageV1,
+) error {
+	requestInfoFrom(ctx).observe(m)
+	if res, ok := m.(*api.ProduceResponse); ok {
+		w.Header().Set(
+			"Location",
+			fmt.Sprintf("/v1/topics/%s/records/%d", s.srv.topic(), res.Offset),
+		)
+		w.WriteHeader(http.StatusCreated)
+	}
+	return nil
+}
+
+// authenticate verifies the request's API key and stores its key id in
+// the request context as the subject authorized by the key's scopes,
+// responding 401 Unauthorized without a valid key. Browsers can't set
+// headers on EventSource and WebSocket requests, so the key may also be
+// passed as the access_token query parameter.
+func (s *httpServer) authenticate(next http.Handler) http.Handler {
+	if s.Keys == nil {
+		return next
+	}
+	h := func(w http.ResponseWriter, r *http.Request) {
+		/* extract the key from a bearer authorization header */
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if key == "" {
+			key = r.URL.Query().Get("access_token")
+		}
+		id, err := s.Keys.Authenticate(key)
+		if key == "" || err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="proglog"`)
+			writeError(w, status.Error(codes.Unauthenticated, "invalid api key"))
+			return
+		}
+		requestInfoFrom(r.Context()).setSubject(id)
+		ctx := context.WithValue(r.Context(), subjectContextKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+	return http.HandlerFunc(h)
+}
+
+// keyAuthorizer authorizes HTTP requests by the scopes of their API key,
+// the key's id being the request's subject. Scopes are named after the
+// actions they allow.
+type keyAuthorizer struct {
+	keys KeyStore
+}
+
+func (a keyAuthorizer) Authorize(subject, object, action string) error {
+	if !a.keys.Allowed(subject, action) {
+		return status.Error(
+			codes.PermissionDenied,
+			"api key lacks scope: "+action,
+		)
+	}
+	return nil
+}
+
+// httpStatus maps an error to the HTTP status matching its gRPC code
+func httpStatus(err error) int {
+	switch status.Code(toStatus(err)) {
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.FailedPrecondition:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/mstreet3/proglog/api/v1"
+	"github.com/mstreet3/proglog/internal/auth"
+	"github.com/mstreet3/proglog/internal/log"
+)
+
+// setupHTTPTest returns a repository backed by a log in a temporary
+// directory
+func setupHTTPTest(t *testing.T) (repo *LogRepository, teardown func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "http-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	return &LogRepository{CommitLog: clog}, func() {
+		clog.Remove()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestHTTPProduceConsume(t *testing.T) {
+	repo, teardown := setupHTTPTest(t)
+	defer teardown()
+	httpsrv, err := NewHTTPServer("", repo, nil)
+	require.NoError(t, err)
+	handler := httpsrv.Handler
+
+	// Produce a record with headers
+	body := `{"record": {"value": "aGVsbG8=", "headers": [{"key": "k", "value": "dg=="}]}}`
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	// The offset is a number, as it always was on this route
+	require.Equal(t, `{"offset":0}`, strings.TrimSpace(w.Body.String()))
+
+	// The record is in the commit log
+	rec, err := repo.CommitLog.Read(context.Background(), 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), rec.Value)
+
+	// Consume it back over HTTP
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", strings.NewReader(`{"offset": 0}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	var cres api.ConsumeResponse
+	require.NoError(t, jsonMarshaler.NewDecoder(w.Body).Decode(&cres))
+	require.Equal(t, []byte("hello"), cres.Record.Value)
+	require.Len(t, cres.Record.Headers, 1)
+	require.Equal(t, "k", cres.Record.Headers[0].Key)
+	require.Equal(t, []byte("v"), cres.Record.Headers[0].Value)
+	require.NotNil(t, cres.Record.AppendTime)
+
+	// Reading past the end is not found
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", strings.NewReader(`{"offset": 1}`)))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestHTTPAPIKeys(t *testing.T) {
+	repo, teardown := setupHTTPTest(t)
+	defer teardown()
+	keys, err := auth.NewKeyStore("../auth/testdata/keys.csv", []byte("secret"))
+	require.NoError(t, err)
+	httpsrv, err := NewHTTPServer("", repo, keys)
+	require.NoError(t, err)
+	handler := httpsrv.Handler
+
+	do := func(method, key, body string) int {
+		req := httptest.NewRequest(method, "/", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	produce := `{"record": {"value": "aGVsbG8="}}`
+	consume := `{"offset": 0}`
+
+	// Missing and invalid keys are unauthorized
+	require.Equal(t, http.StatusUnauthorized, do("POST", "", produce))
+	require.Equal(t, http.StatusUnauthorized, do("POST", "ingest.00", produce))
+
+	// Keys without the route's scope are forbidden
+	require.Equal(t, http.StatusForbidden, do("POST", keys.Sign("dashboard"), produce))
+	require.Equal(t, http.StatusForbidden, do("GET", keys.Sign("ingest"), consume))
+
+	// Keys with the scope are served
+	require.Equal(t, http.StatusOK, do("POST", keys.Sign("ingest"), produce))
+	require.Equal(t, http.StatusOK, do("GET", keys.Sign("dashboard"), consume))
+	require.Equal(t, http.StatusOK, do("GET", keys.Sign("operator"), consume))
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+// jsonMarshaler encodes messages in the proto3 JSON mapping with the field
+// names from log.proto, but keeps the HTTP API's JSON as it was before it
+// was transcoded from log.proto: 64-bit integers such as offsets are
+// numbers rather than strings, and renamed fields are also encoded under
+// their former names
+var jsonMarshaler = &legacyJSONPb{
+	JSONPb: &runtime.JSONPb{OrigName: true, EmitDefaults: true},
+}
+
+// formerNames maps the fields of responses that were renamed to their
+// former names, by message
+var formerNames = map[protoreflect.FullName]map[string]string{
+	(&api.FetchResponse{}).ProtoReflect().Descriptor().FullName(): {
+		"next_offset": "next",
+	},
+	(&api.GetOffsetsResponse{}).ProtoReflect().Descriptor().FullName(): {
+		"lowest_offset": "lowest",
+		"next_offset":   "next",
+	},
+}
+
+type legacyJSONPb struct {
+	*runtime.JSONPb
+}
+
+func (j *legacyJSONPb) Marshal(v interface{}) ([]byte, error) {
+	b, err := j.JSONPb.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(protoreflect.ProtoMessage)
+	if !ok {
+		return b, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var doc interface{}
+	if err = d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(legacyJSON(doc, m.ProtoReflect().Descriptor()))
+}
+
+func (j *legacyJSONPb) NewEncoder(w io.Writer) runtime.Encoder {
+	return runtime.EncoderFunc(func(v interface{}) error {
+		b, err := j.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(b); err != nil {
+			return err
+		}
+		_, err = w.Write(j.Delimiter())
+		return err
+	})
+}
+
+// legacyJSON rewrites the JSON of a message described by md in place
+func legacyJSON(v interface{}, md protoreflect.MessageDescriptor) interface{} {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		// Well-known types such as timestamps are encoded as strings
+		return v
+	}
+	fields := md.Fields()
+	for name, value := range obj {
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil || fd.IsMap() {
+			continue
+		}
+		if !fd.IsList() {
+			obj[name] = legacyValue(value, fd)
+			continue
+		}
+		if list, ok := value.([]interface{}); ok {
+			for i, elem := range list {
+				list[i] = legacyValue(elem, fd)
+			}
+		}
+	}
+	for name, former := range formerNames[md.FullName()] {
+		if value, ok := obj[name]; ok {
+			obj[former] = value
+		}
+	}
+	return obj
+}
+
+// legacyValue rewrites the JSON of a value of the field fd
+func legacyValue(v interface{}, fd protoreflect.FieldDescriptor) interface{} {
+	switch fd.Kind() {
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed64Kind, protoreflect.Uint64Kind,
+		protoreflect.Fixed64Kind:
+		if s, ok := v.(string); ok {
+			return json.Number(s)
+		}
+	case protoreflect.MessageKind:
+		return legacyJSON(v, fd.Message())
+	}
+	return v
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+// requestIDKey names the request id in gRPC metadata and HTTP headers.
+// Clients may pass their own id to correlate their logs with the server's.
+const requestIDKey = "x-request-id"
+
+// logger returns the repository's Logger, which discards everything when
+// it isn't set
+func (c *LogRepository) logger() *zap.Logger {
+	if c.Logger == nil {
+		return zap.NewNop()
+	}
+	return c.Logger
+}
+
+// requestInfo collects what's logged about a request as it's served. The
+// logging interceptors and middleware store it in the request context for
+// the handlers further down the chain to fill in.
+type requestInfo struct {
+	mu      sync.Mutex
+	id      string
+	subject string
+	topic   string
+	offset  *uint64
+}
+
+type requestInfoContextKey struct{}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoContextKey{}, info)
+}
+
+// requestInfoFrom returns the requestInfo of a logged request
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey{}).(*requestInfo)
+	return info
+}
+
+// setSubject records the request's authenticated subject
+func (i *requestInfo) setSubject(subject string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.subject = subject
+}
+
+// observe records the topic and offset of a request or response message
+func (i *requestInfo) observe(m interface{}) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if m, ok := m.(interface{ GetTopic() string }); ok && m.GetTopic() != "" {
+		i.topic = m.GetTopic()
+	}
+	// Failed calls respond with nil messages
+	var off uint64
+	switch m := m.(type) {
+	case *api.ProduceResponse:
+		if m == nil {
+			return
+		}
+		off = m.Offset
+	case *api.ConsumeRequest:
+		off = m.Offset
+	case *api.ConsumeResponse:
+		if m.GetRecord() == nil {
+			return
+		}
+		off = m.Record.Offset
+	case *api.FetchRequest:
+		off = m.Offset
+	default:
+		return
+	}
+	i.offset = &off
+}
+
+func (i *requestInfo) fields() []zap.Field {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	fields := []zap.Field{
+		zap.String("request_id", i.id),
+		zap.String("subject", i.subject),
+	}
+	if i.topic != "" {
+		fields = append(fields, zap.String("topic", i.topic))
+	}
+	if i.offset != nil {
+		fields = append(fields, zap.Uint64("offset", *i.offset))
+	}
+	return fields
+}
+
+// traceFields tie a request's log to its trace, when it's traced
+func traceFields(ctx context.Context) []zap.Field {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+	return []zap.Field{zap.Stringer("trace_id", sc.TraceID())}
+}
+
+// newRequestID returns the id the client sent, or a random one
+func newRequestID(sent string) string {
+	if sent != "" {
+		return sent
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// incomingRequestInfo starts the requestInfo of a gRPC request, replying
+// with its request id in the response headers
+func incomingRequestInfo(ctx context.Context) *requestInfo {
+	var sent string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDKey); len(ids) > 0 {
+			sent = ids[0]
+		}
+	}
+	return &requestInfo{id: newRequestID(sent)}
+}
+
+func (c *LogRepository) loggingUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	start := time.Now()
+	ri := incomingRequestInfo(ctx)
+	_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, ri.id))
+	ri.observe(req)
+	res, err := handler(withRequestInfo(ctx, ri), req)
+	ri.observe(res)
+	c.logCall(ctx, ri, info.FullMethod, start, err)
+	return res, err
+}
+
+func (c *LogRepository) loggingStreamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	start := time.Now()
+	ctx := ss.Context()
+	ri := incomingRequestInfo(ctx)
+	_ = ss.SetHeader(metadata.Pairs(requestIDKey, ri.id))
+	err := handler(srv, &loggedStream{
+		ServerStream: ss,
+		ctx:          withRequestInfo(ctx, ri),
+		info:         ri,
+	})
+	c.logCall(ctx, ri, info.FullMethod, start, err)
+	return err
+}
+
+// loggedStream records the topic and offset of the requests it receives
+type loggedStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	info *requestInfo
+}
+
+func (s *loggedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *loggedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.info.observe(m)
+	}
+	return err
+}
+
+// logCall logs a finished gRPC call at the error level when the server
+// failed it, and at the info level otherwise
+func (c *LogRepository) logCall(
+	ctx context.Context,
+	ri *requestInfo,
+	method string,
+	start time.Time,
+	err error,
+) {
+	code := status.Code(err)
+	fields := append(ri.fields(),
+		zap.String("method", method),
+		zap.String("code", code.String()),
+		zap.Duration("latency", time.Since(start)),
+	)
+	if p, ok := peer.FromContext(ctx); ok {
+		fields = append(fields, zap.Stringer("peer", p.Addr))
+	}
+	fields = append(fields, traceFields(ctx)...)
+	switch {
+	case code == codes.OK && strings.HasPrefix(method, "/grpc.health.v1."):
+		// Health checks are too frequent to log by default
+		c.logger().Debug("grpc call", fields...)
+	case code == codes.Unknown, code == codes.Internal,
+		code == codes.DataLoss, code == codes.Unimplemented:
+		c.logger().Error("grpc call", append(fields, zap.Error(err))...)
+	case code == codes.OK:
+		c.logger().Info("grpc call", fields...)
+	default:
+		c.logger().Info("grpc call", append(fields, zap.Error(err))...)
+	}
+}
+
+// logging logs every HTTP request once it's served, keeping API keys out
+// of the logs
+func (s *httpServer) logging(next http.Handler) http.Handler {
+	logger := s.srv.logger()
+	h := func(w http.ResponseWriter, r *http.Request) {
+		ri := &requestInfo{
+			id:    newRequestID(r.Header.Get(requestIDKey)),
+			topic: mux.Vars(r)["topic"],
+		}
+		w.Header().Set(requestIDKey, ri.id)
+		m := httpsnoop.CaptureMetrics(next, w, r.WithContext(
+			withRequestInfo(r.Context(), ri),
+		))
+
+		query := r.URL.Query()
+		if query.Get("access_token") != "" {
+			query.Set("access_token", "REDACTED")
+		}
+		fields := append(ri.fields(),
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.String("query", query.Encode()),
+			zap.String("peer", r.RemoteAddr),
+			zap.Int("status", m.Code),
+			zap.Int64("bytes", m.Written),
+			zap.Duration("latency", m.Duration),
+		)
+		fields = append(fields, traceFields(r.Context())...)
+		if m.Code >= http.StatusInternalServerError {
+			logger.Error("http request", fields...)
+			return
+		}
+		logger.Info("http request", fields...)
+	}
+	return http.HandlerFunc(h)
+}
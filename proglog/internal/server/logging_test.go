@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+func TestGRPCLogging(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	client, _, _, teardown := setupTest(t, func(repo *LogRepository) {
+		repo.Logger = zap.New(core)
+	})
+	defer teardown()
+
+	// The client's request id is echoed and logged with the call
+	ctx := metadata.AppendToOutgoingContext(
+		context.Background(),
+		requestIDKey, "req-1",
+	)
+	var header metadata.MD
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Topic:  DefaultTopic,
+		Record: &api.Record{Value: []byte("hello world")},
+	}, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Equal(t, []string{"req-1"}, header.Get(requestIDKey))
+
+	// Failed calls are logged with their code
+	_, err = client.Consume(context.Background(), &api.ConsumeRequest{Offset: 1})
+	require.Error(t, err)
+
+	entries := logs.TakeAll()
+	require.Len(t, entries, 2)
+	produce := entries[0].ContextMap()
+	require.Equal(t, "req-1", produce["request_id"])
+	require.Equal(t, "root", produce["subject"])
+	require.Equal(t, "/log.v1.Log/Produce", produce["method"])
+	require.Equal(t, "default", produce["topic"])
+	require.Equal(t, uint64(0), produce["offset"])
+	require.Equal(t, "OK", produce["code"])
+	require.Contains(t, produce, "latency")
+	require.Contains(t, produce, "peer")
+	consume := entries[1].ContextMap()
+	require.NotEmpty(t, consume["request_id"])
+	require.Equal(t, uint64(1), consume["offset"])
+	require.Equal(t, "NotFound", consume["code"])
+	require.Contains(t, consume, "error")
+}
+
+func TestHTTPLogging(t *testing.T) {
+	repo, teardown := setupHTTPTest(t)
+	defer teardown()
+	core, logs := observer.New(zapcore.InfoLevel)
+	repo.Logger = zap.New(core)
+	httpsrv, err := NewHTTPServer("", repo, nil)
+	require.NoError(t, err)
+	handler := httpsrv.Handler
+
+	// A produce is logged with its topic and offset
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(
+		"POST",
+		"/v1/topics/default/records?access_token=secret",
+		strings.NewReader(`{"value": "aGVsbG8="}`),
+	)
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusCreated, w.Code)
+	id := w.Header().Get(requestIDKey)
+	require.NotEmpty(t, id)
+
+	entries := logs.TakeAll()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(t, id, fields["request_id"])
+	require.Equal(t, "POST", fields["method"])
+	require.Equal(t, "/v1/topics/default/records", fields["path"])
+	require.Equal(t, "access_token=REDACTED", fields["query"])
+	require.Equal(t, "default", fields["topic"])
+	require.Equal(t, uint64(0), fields["offset"])
+	require.Equal(t, int64(http.StatusCreated), fields["status"])
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/mstreet3/proglog/api/v1"
+	"github.com/mstreet3/proglog/internal/auth"
+)
+
+func TestREST(t *testing.T) {
+	repo, teardown := setupHTTPTest(t)
+	defer teardown()
+	httpsrv, err := NewHTTPServer("", repo, nil)
+	require.NoError(t, err)
+	handler := httpsrv.Handler
+
+	do := func(method, target, body string, m interface{}) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		if m != nil {
+			require.NoError(t, jsonMarshaler.NewDecoder(w.Body).Decode(m))
+		}
+		return w
+	}
+
+	// An empty log starts and ends at offset zero
+	var offsets api.GetOffsetsResponse
+	w := do("GET", "/v1/topics/default/offsets", "", &offsets)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, uint64(0), offsets.LowestOffset)
+	require.Equal(t, uint64(0), offsets.NextOffset)
+
+	// Appends are created at their offset's URL
+	for i, value := range []string{"Zmlyc3Q=", "c2Vjb25k", "dGhpcmQ="} {
+		var res api.ProduceResponse
+		w = do("POST", "/v1/topics/default/records", `{"value": "`+value+`"}`, &res)
+		require.Equal(t, http.StatusCreated, w.Code)
+		require.Equal(t, uint64(i), res.Offset)
+	}
+	require.Equal(t, "/v1/topics/default/records/2", w.Header().Get("Location"))
+
+	// Records are read by the offset in the URL
+	var rec api.Record
+	w = do("GET", "/v1/topics/default/records/1", "", &rec)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, []byte("second"), rec.Value)
+	require.Equal(t, uint64(1), rec.Offset)
+
+	// Ranges are fetched by query parameters and page with next_offset
+	var page api.FetchResponse
+	w = do("GET", "/v1/topics/default/records?offset=1&max_records=1", "", &page)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, page.Records, 1)
+	require.Equal(t, []byte("second"), page.Records[0].Value)
+	require.Equal(t, uint64(2), page.NextOffset)
+	do("GET", "/v1/topics/default/records?offset=2", "", &page)
+	require.Len(t, page.Records, 1)
+	require.Equal(t, uint64(3), page.NextOffset)
+	do("GET", "/v1/topics/default/records?offset=3", "", &page)
+	require.Empty(t, page.Records)
+	require.Equal(t, uint64(3), page.NextOffset)
+
+	do("GET", "/v1/topics/default/offsets", "", &offsets)
+	require.Equal(t, uint64(3), offsets.NextOffset)
+
+	// Ranges still take the parameters they were first read by, responses
+	// keep their former fields and offsets are numbers
+	legacy := func(target string) map[string]interface{} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		require.Equal(t, http.StatusOK, w.Code, target)
+		var res map[string]interface{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		return res
+	}
+	res := legacy("/v1/topics/default/records?from=1&limit=1")
+	require.Len(t, res["records"], 1)
+	record := res["records"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, float64(1), record["offset"])
+	require.Equal(t, float64(2), res["next"])
+	require.Equal(t, float64(2), res["next_offset"])
+	res = legacy("/v1/topics/default/offsets")
+	require.Equal(t, float64(0), res["lowest"])
+	require.Equal(t, float64(3), res["next"])
+
+	// Errors share one envelope
+	for target, want := range map[string]ErrorBody{
+		"/v1/topics/default/records/3": {
+			Status:  http.StatusNotFound,
+			Code:    "NOT_FOUND",
+			Message: "offset out of range: 3",
+		},
+		"/v1/topics/default/records/x": {
+			Status:  http.StatusBadRequest,
+			Code:    "INVALID_ARGUMENT",
+			Message: "invalid offset",
+		},
+		"/v1/topics/default/records?max_records=-1": {
+			Status:  http.StatusBadRequest,
+			Code:    "INVALID_ARGUMENT",
+			Message: "invalid max_records",
+		},
+		"/v1/topics/default/records?limit=-1": {
+			Status:  http.StatusBadRequest,
+			Code:    "INVALID_ARGUMENT",
+			Message: "invalid limit",
+		},
+		"/v1/topics/other/offsets": {
+			Status:  http.StatusNotFound,
+			Code:    "NOT_FOUND",
+			Message: "topic not found: other",
+		},
+		"/v1/nowhere": {
+			Status:  http.StatusNotFound,
+			Code:    "NOT_FOUND",
+			Message: "Not Found",
+		},
+	} {
+		var res ErrorResponse
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		require.Equal(t, want.Status, w.Code, target)
+		require.Equal(t, want, res.Error, target)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestRESTAPIKeys(t *testing.T) {
+	repo, teardown := setupHTTPTest(t)
+	defer teardown()
+	keys, err := auth.NewKeyStore("../auth/testdata/keys.csv", []byte("secret"))
+	require.NoError(t, err)
+	httpsrv, err := NewHTTPServer("", repo, keys)
+	require.NoError(t, err)
+	handler := httpsrv.Handler
+
+	do := func(method, target, key string) ErrorResponse {
+		req := httptest.NewRequest(method, target, strings.NewReader(`{"value": "aGk="}`))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var res ErrorResponse
+		if w.Code >= 400 {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		}
+		res.Error.Status = w.Code
+		return res
+	}
+
+	// Authentication and scope failures use the error envelope
+	res := do("POST", "/v1/topics/default/records", "")
+	require.Equal(t, http.StatusUnauthorized, res.Error.Status)
+	require.Equal(t, "UNAUTHENTICATED", res.Error.Code)
+	res = do("GET", "/v1/topics/default/records/0", keys.Sign("ingest"))
+	require.Equal(t, http.StatusForbidden, res.Error.Status)
+	require.Equal(t, "PERMISSION_DENIED", res.Error.Code)
+
+	// Keys with the scope are served
+	res = do("POST", "/v1/topics/default/records", keys.Sign("ingest"))
+	require.Equal(t, http.StatusCreated, res.Error.Status)
+	res = do("GET", "/v1/topics/default/records/0", keys.Sign("dashboard"))
+	require.Equal(t, http.StatusOK, res.Error.Status)
+}
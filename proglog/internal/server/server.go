@@ -2,29 +2,173 @@ package server
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	api "github.com/mstreet3/proglog/api/v1"
+	"github.com/mstreet3/proglog/internal/tracing"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
 )
 
 var _ api.LogServer = (*grpcServer)(nil)
 
 type CommitLog interface {
-	Append(record *api.Record) (uint64, error)
-	Read(off uint64) (*api.Record, error)
+	Append(ctx context.Context, record *api.Record) (uint64, error)
+	AppendTxn(
+		ctx context.Context,
+		id uint64,
+		records []*api.Record,
+	) ([]uint64, error)
+	Read(ctx context.Context, off uint64) (*api.Record, error)
+	ReadBatch(
+		ctx context.Context,
+		off, maxRecords, maxBytes uint64,
+	) ([]*api.Record, error)
+	ReadCommitted(ctx context.Context, off uint64) (*api.Record, error)
+	ReadBatchCommitted(
+		ctx context.Context,
+		off, maxRecords, maxBytes uint64,
+	) ([]*api.Record, error)
+	CommittedOffset(group string) (uint64, error)
+	Wait() <-chan struct{}
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
 }
 
+// AcksAppender appends records once they're acknowledged as asked, e.g. a
+// replicated log. The servers append to other logs with Append, which
+// acknowledges as api.Acks_LEADER.
+type AcksAppender interface {
+	AppendAcks(ctx context.Context, record *api.Record, acks api.Acks) (
+		uint64,
+		error,
+	)
+}
+
+// GetServerer lists the servers of a cluster, e.g. a replicated log.
+type GetServerer interface {
+	GetServers() ([]*api.Server, error)
+}
+
+// Leader locates the leader of a replicated log, the only server that can
+// append to it.
+type Leader interface {
+	IsLeader() bool
+	// LeaderAddr returns the leader's gRPC address, empty while it's unknown
+	LeaderAddr() string
+}
+
+// DefaultTopic names a repository's log when its Topic is empty.
+const DefaultTopic = "default"
+
+const (
+	// defaultFetchRecords caps fetches that don't set max_records
+	defaultFetchRecords = 100
+	// maxFetchRecords caps every fetch, whatever its max_records
+	maxFetchRecords = 1000
+)
+
 type LogRepository struct {
-	CommitLog CommitLog
+	CommitLog  CommitLog
+	Authorizer Authorizer
+	// Topic names the log in requests, DefaultTopic when empty
+	Topic string
+	// Logger logs every request served, when it's set
+	Logger *zap.Logger
+	// GetServerer lists the servers of the log's cluster, when it's
+	// clustered
+	GetServerer GetServerer
+	// Leader locates the leader of the log's cluster, when it's replicated.
+	// The other servers forward produce and transaction requests to it, or
+	// refuse them with api.ErrNotLeader when RedirectProduce is set.
+	Leader          Leader
+	RedirectProduce bool
+	// Cluster administers the log's cluster, when it's replicated
+	Cluster Cluster
+	// LeaderDialOptions configure the connection produce and transaction
+	// requests are forwarded over, e.g. the certificate the server authenticates with
+	LeaderDialOptions []grpc.DialOption
+
+	forwarder forwarder
+	drainInit sync.Once
+	drainOnce sync.Once
+	drained   chan struct{}
+}
+
+// Drain starts shutting down the servers of the repository: produce
+// requests are refused with codes.Unavailable, record streams end once
+// they've caught up with the log and long-polls return at once. Requests
+// already appending finish normally, so the log can be closed when the
+// servers have stopped without losing an acknowledged record.
+func (c *LogRepository) Drain() {
+	c.drainOnce.Do(func() {
+		close(c.draining())
+	})
+}
+
+// draining returns a channel closed once Drain has been called
+func (c *LogRepository) draining() chan struct{} {
+	c.drainInit.Do(func() {
+		c.drained = make(chan struct{})
+	})
+	return c.drained
+}
+
+// acceptProduce returns errShuttingDown once the repository is draining
+func (c *LogRepository) acceptProduce() error {
+	select {
+	case <-c.draining():
+		return errShuttingDown()
+	default:
+		return nil
+	}
+}
+
+// topic returns the name the repository's log is served under
+func (c *LogRepository) topic() string {
+	if c.Topic == "" {
+		return DefaultTopic
+	}
+	return c.Topic
+}
+
+// checkTopic returns ErrTopicNotFound unless topic names the repository's
+// log. gRPC clients may leave the topic empty.
+func (c *LogRepository) checkTopic(topic string) error {
+	if topic != "" && topic != c.topic() {
+		return api.ErrTopicNotFound{Topic: topic}
+	}
+	return nil
 }
 
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*LogRepository
+	// authorizer decides the requests, the repository's Authorizer unless
+	// the server is transcoding HTTP requests
+	authorizer Authorizer
 }
 
-func NewGRPCServer(c *LogRepository) (*grpc.Server, error) {
-	gsrv := grpc.NewServer()
+// NewGRPCServer creates a gRPC server serving the log. Options such as
+// grpc.Creds for TLS are passed through to the gRPC server.
+func NewGRPCServer(c *LogRepository, opts ...grpc.ServerOption) (
+	*grpc.Server,
+	error,
+) {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(
+			c.loggingUnaryInterceptor,
+			errorUnaryInterceptor,
+			authenticateUnaryInterceptor,
+		),
+		grpc.ChainStreamInterceptor(
+			c.loggingStreamInterceptor,
+			errorStreamInterceptor,
+			authenticateStreamInterceptor,
+		),
+	)
+	gsrv := grpc.NewServer(opts...)
 	srv, err := newgrpcServer(c)
 	if err != nil {
 		return nil, err
@@ -36,6 +180,7 @@ func NewGRPCServer(c *LogRepository) (*grpc.Server, error) {
 func newgrpcServer(c *LogRepository) (srv *grpcServer, err error) {
 	srv = &grpcServer{
 		LogRepository: c,
+		authorizer:    c.Authorizer,
 	}
 	return srv, nil
 }
@@ -44,7 +189,56 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 	*api.ProduceResponse,
 	error,
 ) {
-	offset, err := s.CommitLog.Append(req.Record)
+	if err := s.authorize(ctx, produceAction); err != nil {
+		return nil, err
+	}
+	if err := s.checkTopic(req.Topic); err != nil {
+		return nil, err
+	}
+	if err := s.acceptProduce(); err != nil {
+		return nil, err
+	}
+	if req.Record == nil {
+		return nil, errMissingField("record")
+	}
+	// Control records and transactional records are only appended by the
+	// transaction RPCs
+	if req.Record.Control != api.Record_DATA {
+		return nil, errInvalidField(
+			"record.control",
+			"Only data records can be produced",
+		)
+	}
+	if req.Record.TransactionId != 0 {
+		return nil, errInvalidField(
+			"record.transaction_id",
+			"Records are added to transactions with AddToTxn",
+		)
+	}
+	if _, ok := api.Acks_name[int32(req.Acks)]; !ok {
+		return nil, errInvalidField(
+			"acks",
+			"Appends are acknowledged by the LEADER or ALL in-sync replicas",
+		)
+	}
+	if s.follower() {
+		return s.forwardProduce(ctx, req)
+	}
+	if req.ProducerId != 0 {
+		req.Record.ProducerId = req.ProducerId
+		req.Record.Sequence = req.Sequence
+	}
+	// The append time is the server's to set
+	req.Record.AppendTime = nil
+	// Consumers of the record link back to this request's trace
+	tracing.Inject(ctx, req.Record)
+	var offset uint64
+	var err error
+	if a, ok := s.CommitLog.(AcksAppender); ok {
+		offset, err = a.AppendAcks(ctx, req.Record, req.Acks)
+	} else {
+		offset, err = s.CommitLog.Append(ctx, req.Record)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -55,53 +249,164 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	*api.ConsumeResponse,
 	error,
 ) {
-	record, err := s.CommitLog.Read(req.Offset)
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	if err := s.checkTopic(req.Topic); err != nil {
+		return nil, err
+	}
+	read := s.CommitLog.Read
+	if req.Isolation == api.IsolationLevel_READ_COMMITTED {
+		read = s.CommitLog.ReadCommitted
+	}
+	record, err := read(ctx, req.Offset)
 	if err != nil {
 		return nil, err
 	}
+	_, span := tracing.Deliver(ctx, record)
+	span.End()
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
-func (s *grpcServer) ProduceStream(
-	req *api.ProduceRequest,
-	stream api.Log_ProduceStreamServer,
-) error {
+// Fetch returns a batch of records starting at the requested offset, at
+// most MaxRecords of them, or 100 when it's unset, and never more than 1000.
+// At the head of the log it long-polls for up to MaxWait and returns an
+// empty batch if nothing was appended in time.
+func (s *grpcServer) Fetch(ctx context.Context, req *api.FetchRequest) (
+	*api.FetchResponse,
+	error,
+) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	if err := s.checkTopic(req.Topic); err != nil {
+		return nil, err
+	}
+	var timeout <-chan time.Time
+	if wait := req.MaxWait.AsDuration(); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	maxRecords := uint64(req.MaxRecords)
+	if maxRecords == 0 {
+		maxRecords = defaultFetchRecords
+	}
+	if maxRecords > maxFetchRecords {
+		maxRecords = maxFetchRecords
+	}
+	readBatch := s.CommitLog.ReadBatch
+	if req.Isolation == api.IsolationLevel_READ_COMMITTED {
+		readBatch = s.CommitLog.ReadBatchCommitted
+	}
 	for {
-		err := stream.RecvMsg(req)
+		// Take the wait channel before reading so no append is missed
+		appended := s.CommitLog.Wait()
+		records, err := readBatch(
+			ctx,
+			req.Offset,
+			maxRecords,
+			req.MaxBytes,
+		)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		res, err := s.Produce(stream.Context(), req)
-		if err != nil {
-			return err
+		if len(records) > 0 || timeout == nil {
+			_, span := tracing.Deliver(ctx, records...)
+			span.End()
+			return fetchResponse(req.Offset, records), nil
 		}
-		if err = stream.Send(res); err != nil {
-			return err
+		select {
+		case <-appended:
+		case <-s.draining():
+			return fetchResponse(req.Offset, nil), nil
+		case <-timeout:
+			return fetchResponse(req.Offset, nil), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
 }
 
+func fetchResponse(off uint64, records []*api.Record) *api.FetchResponse {
+	if len(records) > 0 {
+		off = records[len(records)-1].Offset + 1
+	}
+	return &api.FetchResponse{Records: records, NextOffset: off}
+}
+
+// GetOffsets returns the bounds of the log.
+func (s *grpcServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (
+	*api.GetOffsetsResponse,
+	error,
+) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	if err := s.checkTopic(req.Topic); err != nil {
+		return nil, err
+	}
+	lowest, err := s.CommitLog.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := s.CommitLog.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+	// highest wraps to one below the base offset while the log is empty
+	return &api.GetOffsetsResponse{
+		LowestOffset: lowest,
+		NextOffset:   highest + 1,
+	}, nil
+}
+
+// GetServers lists the servers of the cluster so clients can send each
+// request to the right one. Any authenticated client may list them, however
+// it may use the log.
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (
+	*api.GetServersResponse,
+	error,
+) {
+	if s.GetServerer == nil {
+		return nil, errNotClustered()
+	}
+	servers, err := s.GetServerer.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+// ProduceStream appends the request's record like Produce does, forwarding
+// it to the leader on a follower, and streams back the response. Once the
+// server drains the request is refused with codes.Unavailable.
+func (s *grpcServer) ProduceStream(
+	req *api.ProduceRequest,
+	stream api.Log_ProduceStreamServer,
+) error {
+	res, err := s.Produce(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+	return stream.Send(res)
+}
+
+// ConsumeStream streams the records from the requested offset onward,
+// following the log as records are appended.
 func (s *grpcServer) ConsumeStream(
 	req *api.ConsumeRequest,
 	stream api.Log_ConsumeStreamServer,
 ) error {
-	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
-				return err
-			}
-			if err = stream.Send(res); err != nil {
-				return err
-			}
-			req.Offset++
-		}
+	ctx := stream.Context()
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return err
+	}
+	if err := s.checkTopic(req.Topic); err != nil {
+		return err
+	}
+	send := func(record *api.Record) error {
+		return stream.Send(&api.ConsumeResponse{Record: record})
 	}
+	return s.tail(ctx, req.Offset, req.Isolation, send, nil)
 }
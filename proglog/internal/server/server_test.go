@@ -2,18 +2,38 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/raft"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	api "github.com/mstreet3/proglog/api/v1"
+	"github.com/mstreet3/proglog/internal/auth"
+	"github.com/mstreet3/proglog/internal/certtest"
+	"github.com/mstreet3/proglog/internal/config"
 	"github.com/mstreet3/proglog/internal/log"
 )
 
+// The servers can serve a replicated log just as well as a local one
+var (
+	_ CommitLog    = (*log.DistributedLog)(nil)
+	_ AcksAppender = (*log.DistributedLog)(nil)
+	_ Cluster      = (*log.DistributedLog)(nil)
+)
+
 type grpcTestHelper func(
 	t *testing.T,
 	client api.LogClient,
@@ -24,16 +44,89 @@ func TestServer(t *testing.T) {
 	scenarios := map[string]grpcTestHelper{
 		"produce/consume a message to/from the log succeeds": testProduceConsume,
 		"consume out of bounds error":                        testConsumeOutOfRange,
+		"fetch a batch of records succeeds":                  testFetch,
+		"fetch at the head waits for an append":              testFetchLongPoll,
+		"fetch caps the records returned":                    testFetchCap,
+		"consume stream follows the log":                     testConsumeStream,
+		"produce stream appends each request":                testProduceStream,
+		"draining refuses produces and ends streams":         testDrain,
+		"offsets bound the log's topic":                      testGetOffsets,
+		"servers list the cluster":                           testGetServers,
+		"produce acks reach replicated logs":                 testProduceAcks,
+		"cluster changes go to the leader":                   testClusterAdmin,
+		"retried produce is appended once":                   testProduceIdempotent,
+		"transactions are read committed":                    testTransactions,
+		"record metadata round trips":                        testRecordMetadata,
+		"errors carry status codes and details":              testErrorDetails,
 	}
 	for scenario, fn := range scenarios {
 		t.Run(scenario, func(t *testing.T) {
-			client, repo, teardown := setupTest(t, nil)
+			client, _, repo, teardown := setupTest(t, nil)
 			defer teardown()
 			fn(t, client, repo)
 		})
 	}
 }
 
+func TestUnauthorized(t *testing.T) {
+	_, nobody, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := nobody.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = nobody.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	stream, err := nobody.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = nobody.BeginTxn(ctx, &api.BeginTxnRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = nobody.RemoveServer(ctx, &api.RemoveServerRequest{Id: "1"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestTopicAuthorization(t *testing.T) {
+	ctx := context.Background()
+	for topic, allowed := range map[string]bool{"logs": true, "other": false} {
+		// The policy lets the reader consume the logs topic only
+		client, _, _, teardown := setupTest(t, func(repo *LogRepository) {
+			repo.Topic = topic
+			repo.Authorizer = authorizeAs{repo.Authorizer, "reader"}
+		})
+
+		_, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+		if allowed {
+			require.NoError(t, err, topic)
+		} else {
+			require.Equal(t, codes.PermissionDenied, status.Code(err), topic)
+		}
+
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.Equal(t, codes.PermissionDenied, status.Code(err), topic)
+		teardown()
+	}
+}
+
+// authorizeAs authorizes every request as the subject
+type authorizeAs struct {
+	Authorizer
+	subject string
+}
+
+func (a authorizeAs) Authorize(_, object, action string) error {
+	return a.Authorizer.Authorize(a.subject, object, action)
+}
+
 func testProduceConsume(t *testing.T, client api.LogClient, repo *LogRepository) {
 	ctx := context.Background()
 	expected := api.Record{
@@ -81,17 +174,586 @@ func testConsumeOutOfRange(t *testing.T, client api.LogClient, repo *LogReposito
 	require.Equal(t, got, want)
 }
 
+func testFetch(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+	values := []string{"first", "second", "third"}
+	for _, v := range values {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(v)},
+		})
+		require.NoError(t, err)
+	}
+
+	// Fetch all records in one batch
+	res, err := client.Fetch(ctx, &api.FetchRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Len(t, res.Records, len(values))
+	for i, rec := range res.Records {
+		require.Equal(t, uint64(i), rec.Offset)
+		require.Equal(t, []byte(values[i]), rec.Value)
+	}
+
+	// Fetch is bounded by max records
+	res, err = client.Fetch(ctx, &api.FetchRequest{Offset: 1, MaxRecords: 1})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, uint64(1), res.Records[0].Offset)
+
+	// Fetch at the head without waiting returns an empty batch
+	res, err = client.Fetch(ctx, &api.FetchRequest{Offset: 3})
+	require.NoError(t, err)
+	require.Empty(t, res.Records)
+}
+
+func testFetchCap(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+	for i := 0; i < maxFetchRecords+1; i++ {
+		_, err := repo.CommitLog.Append(ctx, &api.Record{Value: []byte("v")})
+		require.NoError(t, err)
+	}
+
+	// Fetches without max records get a default batch
+	res, err := client.Fetch(ctx, &api.FetchRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Len(t, res.Records, defaultFetchRecords)
+	require.Equal(t, uint64(defaultFetchRecords), res.NextOffset)
+
+	// No fetch gets more than the maximum
+	res, err = client.Fetch(ctx, &api.FetchRequest{
+		Offset:     0,
+		MaxRecords: maxFetchRecords + 1,
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Records, maxFetchRecords)
+}
+
+func testFetchLongPoll(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+
+	// Fetch times out with an empty batch when nothing is appended
+	res, err := client.Fetch(ctx, &api.FetchRequest{
+		MaxWait: durationpb.New(10 * time.Millisecond),
+	})
+	require.NoError(t, err)
+	require.Empty(t, res.Records)
+
+	// Fetch returns as soon as a record is appended
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, err := repo.CommitLog.Append(ctx, &api.Record{Value: []byte("late")})
+		require.NoError(t, err)
+	}()
+	res, err = client.Fetch(ctx, &api.FetchRequest{
+		MaxWait: durationpb.New(10 * time.Second),
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, []byte("late"), res.Records[0].Value)
+}
+
+func testConsumeStream(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := repo.CommitLog.Append(ctx, &api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	// The stream sends existing records then waits for appends
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), res.Record.Value)
+	_, err = repo.CommitLog.Append(ctx, &api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), res.Record.Value)
+	require.Equal(t, uint64(1), res.Record.Offset)
+
+	// A stream past the head waits for the log to reach its offset
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 3})
+	require.NoError(t, err)
+	for _, value := range []string{"third", "fourth"} {
+		_, err = repo.CommitLog.Append(ctx, &api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("fourth"), res.Record.Value)
+	require.Equal(t, uint64(3), res.Record.Offset)
+}
+
+func testProduceStream(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+	for i, value := range []string{"first", "second"} {
+		stream, err := client.ProduceStream(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Offset)
+		_, err = stream.Recv()
+		require.Equal(t, io.EOF, err)
+	}
+}
+
+func testDrain(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("first")},
+	})
+	require.NoError(t, err)
+	consumeStream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	res, err := consumeStream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), res.Record.Value)
+
+	repo.Drain()
+
+	// Idle streams end and produces are refused
+	_, err = consumeStream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("second")},
+	})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	produceStream, err := client.ProduceStream(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("second")},
+	})
+	require.NoError(t, err)
+	_, err = produceStream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// Reads are still served
+	cres, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), cres.Record.Value)
+}
+
+func testGetOffsets(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	// The topic may be left empty or name the log
+	for _, topic := range []string{"", DefaultTopic} {
+		res, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{Topic: topic})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), res.LowestOffset)
+		require.Equal(t, uint64(2), res.NextOffset)
+	}
+
+	// Other topics don't exist
+	_, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{Topic: "other"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Topic:  "other",
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testGetServers(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+	_, err := client.GetServers(ctx, &api.GetServersRequest{})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	want := []*api.Server{
+		{Id: "0", RpcAddr: "127.0.0.1:8400", IsLeader: true},
+		{Id: "1", RpcAddr: "127.0.0.1:8401"},
+	}
+	repo.GetServerer = servers(want)
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Servers, len(want))
+	for i, server := range res.Servers {
+		require.True(t, proto.Equal(want[i], server))
+	}
+}
+
+type servers []*api.Server
+
+func (s servers) GetServers() ([]*api.Server, error) {
+	return s, nil
+}
+
+func testProduceAcks(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+	l := &acksLog{Log: repo.CommitLog.(*log.Log)}
+	repo.CommitLog = l
+	for _, acks := range []api.Acks{api.Acks_LEADER, api.Acks_ALL} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+			Acks:   acks,
+		})
+		require.NoError(t, err)
+		require.Equal(t, acks, l.acks)
+	}
+
+	// Appends are always acknowledged, so no level returns before they are
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Acks:   api.Acks(1),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Losing the leadership mid-append is worth retrying
+	for _, err = range []error{raft.ErrNotLeader, raft.ErrLeadershipLost} {
+		l.err = err
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+			Acks:   api.Acks_ALL,
+		})
+		st := status.Convert(err)
+		require.Equal(t, codes.Unavailable, st.Code())
+		require.Len(t, st.Details(), 1)
+		_, ok := st.Details()[0].(*errdetails.RetryInfo)
+		require.True(t, ok)
+	}
+}
+
+// acksLog is a log recording the acks it was last asked to append with,
+// failing appends with err when it's set
+type acksLog struct {
+	*log.Log
+	acks api.Acks
+	err  error
+}
+
+func (l *acksLog) AppendAcks(
+	ctx context.Context,
+	record *api.Record,
+	acks api.Acks,
+) (uint64, error) {
+	l.acks = acks
+	if l.err != nil {
+		return 0, l.err
+	}
+	return l.Log.Append(ctx, record)
+}
+
+func testClusterAdmin(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+	_, err := client.RemoveServer(ctx, &api.RemoveServerRequest{Id: "1"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.GetClusterState(ctx, &api.GetClusterStateRequest{})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	c := &cluster{}
+	repo.Cluster = c
+	_, err = client.AddServer(ctx, &api.AddServerRequest{
+		Id:       "1",
+		RpcAddr:  "127.0.0.1:8401",
+		Suffrage: api.Suffrage_NONVOTER,
+	})
+	require.NoError(t, err)
+	_, err = client.PromoteServer(ctx, &api.PromoteServerRequest{Id: "1"})
+	require.NoError(t, err)
+	_, err = client.DemoteServer(ctx, &api.DemoteServerRequest{Id: "1"})
+	require.NoError(t, err)
+	_, err = client.TransferLeadership(ctx, &api.TransferLeadershipRequest{})
+	require.NoError(t, err)
+	_, err = client.RemoveServer(ctx, &api.RemoveServerRequest{Id: "1"})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"add 1 127.0.0.1:8401 NONVOTER",
+		"promote 1",
+		"demote 1",
+		"transfer ",
+		"remove 1",
+	}, c.changes)
+	_, err = client.RemoveServer(ctx, &api.RemoveServerRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Followers name the leader to change the cluster on instead
+	repo.Leader = &leader{addr: "127.0.0.1:8400"}
+	_, err = client.RemoveServer(ctx, &api.RemoveServerRequest{Id: "1"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	addr, ok := api.LeaderAddr(err)
+	require.True(t, ok)
+	require.Equal(t, "127.0.0.1:8400", addr)
+	require.Len(t, c.changes, 5)
+
+	// but describe it themselves
+	res, err := client.GetClusterState(ctx, &api.GetClusterStateRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "0", res.ServerId)
+}
+
+// cluster records the changes asked of it
+type cluster struct {
+	changes []string
+}
+
+func (c *cluster) AddServer(id, addr string, suffrage api.Suffrage) error {
+	c.changes = append(c.changes, fmt.Sprintf("add %s %s %s", id, addr, suffrage))
+	return nil
+}
+
+func (c *cluster) PromoteServer(id string) error {
+	c.changes = append(c.changes, "promote "+id)
+	return nil
+}
+
+func (c *cluster) DemoteServer(id string) error {
+	c.changes = append(c.changes, "demote "+id)
+	return nil
+}
+
+func (c *cluster) RemoveServer(id string) error {
+	c.changes = append(c.changes, "remove "+id)
+	return nil
+}
+
+func (c *cluster) TransferLeadership(id string) error {
+	c.changes = append(c.changes, "transfer "+id)
+	return nil
+}
+
+func (c *cluster) GetClusterState() (*api.GetClusterStateResponse, error) {
+	return &api.GetClusterStateResponse{ServerId: "0"}, nil
+}
+
+func testProduceIdempotent(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+	req := &api.ProduceRequest{
+		Record:     &api.Record{Value: []byte("hello world")},
+		ProducerId: 1,
+		Sequence:   0,
+	}
+	res, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+
+	// Retry the same request
+	res, err = client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+
+	// Nothing was appended after the first record
+	cres, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Nil(t, cres)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// An out of order sequence is rejected
+	req.Sequence = 2
+	_, err = client.Produce(ctx, req)
+	got := status.Code(err)
+	want := status.Code(api.ErrOutOfOrderSequence{}.GRPCStatus().Err())
+	require.Equal(t, want, got)
+}
+
+func testTransactions(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+	readCommitted := func(off uint64) (*api.ConsumeResponse, error) {
+		return client.Consume(ctx, &api.ConsumeRequest{
+			Offset:    off,
+			Isolation: api.IsolationLevel_READ_COMMITTED,
+		})
+	}
+
+	// Transactions only run on the server's own topic
+	_, err := client.BeginTxn(ctx, &api.BeginTxnRequest{Topic: "other"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Abort a transaction
+	txn, err := client.BeginTxn(ctx, &api.BeginTxnRequest{Topic: repo.topic()})
+	require.NoError(t, err)
+	_, err = client.AddToTxn(ctx, &api.AddToTxnRequest{
+		TransactionId: txn.TransactionId,
+		Records:       []*api.Record{{Value: []byte("aborted")}},
+	})
+	require.NoError(t, err)
+	_, err = client.AbortTxn(ctx, &api.AbortTxnRequest{
+		TransactionId: txn.TransactionId,
+	})
+	require.NoError(t, err)
+
+	// Write a record and commit an offset in a transaction
+	txn, err = client.BeginTxn(ctx, &api.BeginTxnRequest{})
+	require.NoError(t, err)
+	added, err := client.AddToTxn(ctx, &api.AddToTxnRequest{
+		TransactionId: txn.TransactionId,
+		Records:       []*api.Record{{Value: []byte("committed")}},
+		Offsets:       []*api.OffsetCommit{{Group: "g", Offset: 7}},
+	})
+	require.NoError(t, err)
+	require.Len(t, added.Offsets, 1)
+
+	// Nothing is visible while the transaction is open
+	_, err = readCommitted(0)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "g"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.CommitTxn(ctx, &api.CommitTxnRequest{
+		TransactionId: txn.TransactionId,
+	})
+	require.NoError(t, err)
+
+	// Only the committed record and offset are visible
+	res, err := readCommitted(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("committed"), res.Record.Value)
+	require.Equal(t, added.Offsets[0], res.Record.Offset)
+	off, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "g"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off.Offset)
+
+	// A committed transaction cannot be committed again
+	_, err = client.CommitTxn(ctx, &api.CommitTxnRequest{
+		TransactionId: txn.TransactionId,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Records are added all at once or not at all
+	txn, err = client.BeginTxn(ctx, &api.BeginTxnRequest{})
+	require.NoError(t, err)
+	highest, err := repo.CommitLog.HighestOffset()
+	require.NoError(t, err)
+	_, err = client.AddToTxn(ctx, &api.AddToTxnRequest{
+		TransactionId: txn.TransactionId,
+		Records: []*api.Record{
+			{Value: []byte("first"), ProducerId: 9, Sequence: 0},
+			{Value: []byte("skipped"), ProducerId: 9, Sequence: 5},
+		},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	after, err := repo.CommitLog.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, highest, after)
+}
+
+func testRecordMetadata(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+	expected := &api.Record{
+		Value: []byte("hello world"),
+		Key:   []byte("key"),
+		Headers: []*api.Header{
+			{Key: "trace-id", Value: []byte("abc")},
+			{Key: "content-type", Value: []byte("text/plain")},
+		},
+		Timestamp: timestamppb.New(time.Unix(1, 0)),
+	}
+	res, err := client.Produce(ctx, &api.ProduceRequest{Record: expected})
+	require.NoError(t, err)
+
+	cres, err := client.Consume(ctx, &api.ConsumeRequest{Offset: res.Offset})
+	require.NoError(t, err)
+	require.Equal(t, expected.Key, cres.Record.Key)
+	require.Len(t, cres.Record.Headers, 2)
+	for i, h := range expected.Headers {
+		require.Equal(t, h.Key, cres.Record.Headers[i].Key)
+		require.Equal(t, h.Value, cres.Record.Headers[i].Value)
+	}
+	require.True(t, expected.Timestamp.AsTime().Equal(cres.Record.Timestamp.AsTime()))
+	require.NotNil(t, cres.Record.AppendTime)
+	require.True(t, cres.Record.AppendTime.AsTime().After(expected.Timestamp.AsTime()))
+}
+
+func testErrorDetails(t *testing.T, client api.LogClient, repo *LogRepository) {
+	ctx := context.Background()
+
+	// A produce without a record is a bad request
+	_, err := client.Produce(ctx, &api.ProduceRequest{})
+	st := status.Convert(err)
+	require.Equal(t, codes.InvalidArgument, st.Code())
+	require.Len(t, st.Details(), 1)
+	_, ok := st.Details()[0].(*errdetails.BadRequest)
+	require.True(t, ok)
+
+	// Only the transaction RPCs append control and transactional records
+	for field, record := range map[string]*api.Record{
+		"record.control":        {Control: api.Record_COMMIT},
+		"record.transaction_id": {TransactionId: 1},
+	} {
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: record})
+		st = status.Convert(err)
+		require.Equal(t, codes.InvalidArgument, st.Code(), field)
+		require.Len(t, st.Details(), 1)
+		badRequest, ok := st.Details()[0].(*errdetails.BadRequest)
+		require.True(t, ok)
+		require.Equal(t, field, badRequest.FieldViolations[0].Field)
+	}
+
+	// A full segment is worth retrying once the log has rolled
+	clog := repo.CommitLog.(*log.Log)
+	repo.CommitLog = &acksLog{Log: clog, err: api.ErrSegmentFull{}}
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	st = status.Convert(err)
+	require.Equal(t, codes.ResourceExhausted, st.Code())
+	require.NotNil(t, retryInfo(st))
+	repo.CommitLog = clog
+
+	// A closed log is unavailable and worth retrying
+	require.NoError(t, clog.Close())
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	st = status.Convert(err)
+	require.Equal(t, codes.Unavailable, st.Code())
+	require.NotNil(t, retryInfo(st))
+}
+
+// retryInfo returns the RetryInfo detail of the status, nil without one
+func retryInfo(st *status.Status) *errdetails.RetryInfo {
+	for _, d := range st.Details() {
+		if r, ok := d.(*errdetails.RetryInfo); ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// setupTest serves a log over mutual TLS and returns a client for the root
+// subject, which may produce and consume, and one for the nobody subject,
+// which may do neither.
 func setupTest(t *testing.T, fn func(*LogRepository)) (
 	client api.LogClient,
+	nobody api.LogClient,
 	repo *LogRepository,
 	teardown func(),
 ) {
 	t.Helper()
-	l, err := net.Listen("tcp", ":0")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// Generate certificates for mutual TLS
+	certDir, err := ioutil.TempDir("", "server-test-certs")
+	require.NoError(t, err)
+	ca, err := certtest.NewCA(certDir)
+	require.NoError(t, err)
+	serverCert, serverKey, err := ca.Issue("server", true)
 	require.NoError(t, err)
+	newClient := func(name string) (*grpc.ClientConn, api.LogClient) {
+		cert, key, err := ca.Issue(name, false)
+		require.NoError(t, err)
+		creds, err := config.DialOption(config.TLSConfig{
+			CertFile:      cert,
+			KeyFile:       key,
+			CAFile:        ca.File,
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+		cc, err := grpc.Dial(l.Addr().String(), creds)
+		require.NoError(t, err)
+		return cc, api.NewLogClient(cc)
+	}
+	rootConn, client := newClient("root")
+	nobodyConn, nobody := newClient("nobody")
 
-	clientOptions := []grpc.DialOption{grpc.WithInsecure()}
-	cc, err := grpc.Dial(l.Addr().String(), clientOptions...)
+	authorizer, err := auth.New(
+		"../auth/testdata/model.conf",
+		"../auth/testdata/policy.csv",
+	)
 	require.NoError(t, err)
 
 	dir, err := ioutil.TempDir("", "server-test")
@@ -101,23 +763,31 @@ func setupTest(t *testing.T, fn func(*LogRepository)) (
 	require.NoError(t, err)
 
 	repo = &LogRepository{
-		CommitLog: clog,
+		CommitLog:  clog,
+		Authorizer: authorizer,
 	}
 	if fn != nil {
 		fn(repo)
 	}
-	server, err := NewGRPCServer(repo)
+	serverCreds, err := config.ServerOption(config.TLSConfig{
+		CertFile: serverCert,
+		KeyFile:  serverKey,
+		CAFile:   ca.File,
+	})
+	require.NoError(t, err)
+	server, err := NewGRPCServer(repo, serverCreds)
 	require.NoError(t, err)
 
 	go func() {
 		server.Serve(l)
 	}()
 
-	client = api.NewLogClient(cc)
-	return client, repo, func() {
+	return client, nobody, repo, func() {
 		server.Stop()
-		cc.Close()
+		rootConn.Close()
+		nobodyConn.Close()
 		l.Close()
 		clog.Remove()
+		os.RemoveAll(certDir)
 	}
 }
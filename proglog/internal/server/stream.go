@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+// writeWait bounds how long a WebSocket write may block
+const writeWait = 10 * time.Second
+
+var upgrader = websocket.Upgrader{}
+
+// streamStart authorizes a stream request and returns where it starts
+// reading and with which isolation. A Last-Event-ID header, sent by
+// reconnecting EventSources, resumes after that record and takes
+// precedence over the "from" query parameter.
+func (s *httpServer) streamStart(r *http.Request) (uint64, api.IsolationLevel, error) {
+	if err := s.srv.authorize(r.Context(), consumeAction); err != nil {
+		return 0, 0, err
+	}
+	if err := s.srv.checkTopic(mux.Vars(r)["topic"]); err != nil {
+		return 0, 0, err
+	}
+	var off uint64
+	q := r.URL.Query()
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return 0, 0, status.Error(codes.InvalidArgument, "invalid Last-Event-ID")
+		}
+		off = n + 1
+	} else if from := q.Get("from"); from != "" {
+		n, err := strconv.ParseUint(from, 10, 64)
+		if err != nil {
+			return 0, 0, status.Error(codes.InvalidArgument, "invalid from")
+		}
+		off = n
+	}
+	isolation := api.IsolationLevel_READ_UNCOMMITTED
+	if name := q.Get("isolation"); name != "" {
+		level, ok := api.IsolationLevel_value[strings.ToUpper(name)]
+		if !ok {
+			return 0, 0, status.Error(codes.InvalidArgument, "invalid isolation")
+		}
+		isolation = api.IsolationLevel(level)
+	}
+	return off, isolation, nil
+}
+
+// handleSSE streams records as Server-Sent Events whose ids are the
+// records' offsets. Idle streams get a comment as a heartbeat, and a
+// failure after the stream started is sent as an "error" event holding
+// an ErrorResponse.
+func (s *httpServer) handleSSE(w http.ResponseWriter, r *http.Request) {
+	off, isolation, err := s.streamStart(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, status.Error(codes.Unimplemented, "streaming unsupported"))
+		return
+	}
+
+	/* start the event stream */
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	/* follow the log, flushing every event */
+	send := func(record *api.Record) error {
+		data, err := jsonMarshaler.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", record.Offset, data)
+		flusher.Flush()
+		return err
+	}
+	heartbeat := func() error {
+		_, err := fmt.Fprint(w, ": heartbeat\n\n")
+		flusher.Flush()
+		return err
+	}
+	err = s.srv.tail(r.Context(), off, isolation, send, heartbeat)
+	if err != nil && r.Context().Err() == nil {
+		data, _ := json.Marshal(errorResponse(err))
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+}
+
+// handleWebSocket streams records as JSON text messages over a WebSocket.
+// Idle connections are pinged as a heartbeat, and a failure after the
+// upgrade is sent as an ErrorResponse message before closing.
+func (s *httpServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	off, isolation, err := s.streamStart(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already responded
+		return
+	}
+	defer conn.Close()
+
+	/* read until the client goes away so control frames are handled */
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	/* follow the log */
+	send := func(record *api.Record) error {
+		data, err := jsonMarshaler.Marshal(record)
+		if err != nil {
+			return err
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+	heartbeat := func() error {
+		return conn.WriteControl(
+			websocket.PingMessage,
+			nil,
+			time.Now().Add(writeWait),
+		)
+	}
+	err = s.srv.tail(ctx, off, isolation, send, heartbeat)
+	if err != nil && ctx.Err() == nil {
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		conn.WriteJSON(errorResponse(err))
+	}
+	conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(writeWait),
+	)
+}
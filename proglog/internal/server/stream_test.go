@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	api "github.com/mstreet3/proglog/api/v1"
+)
+
+// setupStreamTest serves a log holding two records over HTTP with a short
+// heartbeat interval
+func setupStreamTest(t *testing.T) (
+	repo *LogRepository,
+	srv *httptest.Server,
+	teardown func(),
+) {
+	t.Helper()
+	repo, teardownLog := setupHTTPTest(t)
+	for _, value := range []string{"first", "second"} {
+		_, err := repo.CommitLog.Append(context.Background(), &api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	interval := heartbeatInterval
+	heartbeatInterval = 20 * time.Millisecond
+	httpsrv, err := NewHTTPServer("", repo, nil)
+	require.NoError(t, err)
+	srv = httptest.NewServer(httpsrv.Handler)
+	return repo, srv, func() {
+		srv.Close()
+		heartbeatInterval = interval
+		teardownLog()
+	}
+}
+
+// readEvent reads the next event or comment from an event stream
+func readEvent(t *testing.T, r *bufio.Reader) (event map[string]string) {
+	t.Helper()
+	event = make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return event
+		}
+		if strings.HasPrefix(line, ":") {
+			event["comment"] = strings.TrimSpace(line[1:])
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		event[parts[0]] = parts[1]
+	}
+}
+
+func TestSSE(t *testing.T) {
+	repo, srv, teardown := setupStreamTest(t)
+	defer teardown()
+
+	stream := func(lastEventID string) (*bufio.Reader, func()) {
+		req, err := http.NewRequest("GET", srv.URL+"/v1/topics/default/stream?from=0", nil)
+		require.NoError(t, err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+		return bufio.NewReader(res.Body), func() { res.Body.Close() }
+	}
+
+	// Existing records are sent with their offsets as ids
+	r, done := stream("")
+	defer done()
+	for i, value := range []string{"first", "second"} {
+		event := readEvent(t, r)
+		require.Equal(t, []string{"0", "1"}[i], event["id"])
+		var rec api.Record
+		require.NoError(t, jsonMarshaler.Unmarshal([]byte(event["data"]), &rec))
+		require.Equal(t, []byte(value), rec.Value)
+	}
+
+	// An idle stream sends heartbeats until a record is appended
+	require.Equal(t, "heartbeat", readEvent(t, r)["comment"])
+	_, err := repo.CommitLog.Append(context.Background(), &api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	event := readEvent(t, r)
+	for event["comment"] != "" {
+		event = readEvent(t, r)
+	}
+	require.Equal(t, "2", event["id"])
+
+	// Reconnecting resumes after the last event id
+	r, done = stream("1")
+	defer done()
+	require.Equal(t, "2", readEvent(t, r)["id"])
+}
+
+func TestWebSocket(t *testing.T) {
+	repo, srv, teardown := setupStreamTest(t)
+	defer teardown()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/topics/default/ws?from=1"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+
+	// Records are sent as JSON messages from the requested offset
+	read := func() *api.Record {
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		var rec api.Record
+		require.NoError(t, jsonMarshaler.Unmarshal(data, &rec))
+		return &rec
+	}
+	rec := read()
+	require.Equal(t, []byte("second"), rec.Value)
+	require.Equal(t, uint64(1), rec.Offset)
+
+	// An idle connection is pinged until a record is appended
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, err := repo.CommitLog.Append(context.Background(), &api.Record{Value: []byte("third")})
+		require.NoError(t, err)
+	}()
+	rec = read()
+	require.Equal(t, []byte("third"), rec.Value)
+	select {
+	case <-pinged:
+	default:
+		t.Fatal("expected a heartbeat ping")
+	}
+}
+
+func TestTailHeartbeat(t *testing.T) {
+	repo, teardown := setupHTTPTest(t)
+	defer teardown()
+	interval := heartbeatInterval
+	heartbeatInterval = 50 * time.Millisecond
+	defer func() {
+		heartbeatInterval = interval
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sent := make(chan struct{}, 1)
+	send := func(*api.Record) error {
+		select {
+		case sent <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	beats := make(chan struct{}, 1)
+	heartbeat := func() error {
+		select {
+		case beats <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = repo.tail(ctx, 0, api.IsolationLevel_READ_UNCOMMITTED, send, heartbeat)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// A busy tail sends no heartbeats
+	for i := 0; i < 20; i++ {
+		_, err := repo.CommitLog.Append(ctx, &api.Record{Value: []byte("busy")})
+		require.NoError(t, err)
+		<-sent
+		select {
+		case <-beats:
+			t.Fatal("unexpected heartbeat while sending records")
+		default:
+		}
+		time.Sleep(heartbeatInterval / 5)
+	}
+
+	// An idle one does
+	select {
+	case <-beats:
+	case <-time.After(time.Second):
+		t.Fatal("expected a heartbeat")
+	}
+}
+
+func TestStreamInvalidStart(t *testing.T) {
+	repo, teardown := setupHTTPTest(t)
+	defer teardown()
+	httpsrv, err := NewHTTPServer("", repo, nil)
+	require.NoError(t, err)
+	handler := httpsrv.Handler
+
+	for _, target := range []string{
+		"/v1/topics/default/stream?from=x",
+		"/v1/topics/default/ws?isolation=serializable",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		require.Equal(t, http.StatusBadRequest, w.Code, target)
+		var res ErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		require.Equal(t, "INVALID_ARGUMENT", res.Error.Code)
+	}
+}
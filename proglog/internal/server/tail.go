@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	api "github.com/mstreet3/proglog/api/v1"
+	"github.com/mstreet3/proglog/internal/tracing"
+)
+
+// tailBatchSize bounds each read while following the log
+const tailBatchSize = 100
+
+// heartbeatInterval is how long a tail waits at the head of the log
+// before calling its heartbeat
+var heartbeatInterval = 15 * time.Second
+
+// tail sends each record from off onward to send, waiting at the head of
+// the log, or until the log reaches off when it's past the head, for more
+// to be appended, until ctx is done or send fails. Once the repository
+// drains, tail returns errShuttingDown when it has caught up with the log.
+// When heartbeat is not nil it's called whenever the tail has been idle for
+// heartbeatInterval, so clients and proxies can tell a quiet log from a
+// dead connection.
+func (c *LogRepository) tail(
+	ctx context.Context,
+	off uint64,
+	isolation api.IsolationLevel,
+	send func(*api.Record) error,
+	heartbeat func() error,
+) error {
+	readBatch := c.CommitLog.ReadBatch
+	if isolation == api.IsolationLevel_READ_COMMITTED {
+		readBatch = c.CommitLog.ReadBatchCommitted
+	}
+	interval := heartbeatInterval
+	var beat *time.Timer
+	var beats <-chan time.Time
+	if heartbeat != nil {
+		beat = time.NewTimer(interval)
+		defer beat.Stop()
+		beats = beat.C
+	}
+	for {
+		// Take the wait channel before reading so no append is missed
+		appended := c.CommitLog.Wait()
+		records, err := readBatch(ctx, off, tailBatchSize, 0)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok && c.pastHead(off) {
+			// Wait for the log to grow to the offset
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			if off, err = c.deliver(ctx, records, send); err != nil {
+				return err
+			}
+			// The tail isn't idle while it's sending records
+			resetHeartbeat(beat, interval)
+			continue
+		}
+		select {
+		case <-appended:
+		case <-c.draining():
+			return errShuttingDown()
+		case <-beats:
+			if err = heartbeat(); err != nil {
+				return err
+			}
+			beat.Reset(interval)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// resetHeartbeat restarts the wait for the next heartbeat, when the tail
+// has one
+func resetHeartbeat(beat *time.Timer, interval time.Duration) {
+	if beat == nil {
+		return
+	}
+	if !beat.Stop() {
+		select {
+		case <-beat.C:
+		default:
+		}
+	}
+	beat.Reset(interval)
+}
+
+// pastHead reports whether off is beyond the head of the log rather than
+// below its lowest offset
+func (c *LogRepository) pastHead(off uint64) bool {
+	lowest, err := c.CommitLog.LowestOffset()
+	return err == nil && off >= lowest
+}
+
+// deliver sends a batch of records within one span and returns the offset
+// following the last record sent
+func (c *LogRepository) deliver(
+	ctx context.Context,
+	records []*api.Record,
+	send func(*api.Record) error,
+) (next uint64, err error) {
+	_, span := tracing.Deliver(ctx, records...)
+	defer span.End()
+	for _, record := range records {
+		if err = send(record); err != nil {
+			return next, err
+		}
+		next = record.Offset + 1
+	}
+	return next, nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/mstreet3/proglog/api/v1"
+	"github.com/mstreet3/proglog/internal/tracing"
+	"google.golang.org/protobuf/proto"
+)
+
+// BeginTxn appends a BEGIN marker and returns the id the log assigned to
+// the new transaction. Like the other transaction RPCs it's forwarded to
+// the leader on a follower, as Produce is.
+func (s *grpcServer) BeginTxn(ctx context.Context, req *api.BeginTxnRequest) (
+	*api.BeginTxnResponse,
+	error,
+) {
+	if err := s.authorize(ctx, produceAction); err != nil {
+		return nil, err
+	}
+	if err := s.checkTopic(req.Topic); err != nil {
+		return nil, err
+	}
+	if err := s.acceptProduce(); err != nil {
+		return nil, err
+	}
+	if s.follower() {
+		client, ctx, err := s.leaderClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return client.BeginTxn(ctx, req)
+	}
+	off, err := s.CommitLog.Append(ctx, &api.Record{Control: api.Record_BEGIN})
+	if err != nil {
+		return nil, err
+	}
+	marker, err := s.CommitLog.Read(ctx, off)
+	if err != nil {
+		return nil, err
+	}
+	return &api.BeginTxnResponse{TransactionId: marker.TransactionId}, nil
+}
+
+// AddToTxn appends records and consumer offset commits to an open
+// transaction, all of them or none. They stay hidden from READ_COMMITTED readers until the
+// transaction commits.
+func (s *grpcServer) AddToTxn(ctx context.Context, req *api.AddToTxnRequest) (
+	*api.AddToTxnResponse,
+	error,
+) {
+	if err := s.authorize(ctx, produceAction); err != nil {
+		return nil, err
+	}
+	if err := s.checkTopic(req.Topic); err != nil {
+		return nil, err
+	}
+	if err := s.acceptProduce(); err != nil {
+		return nil, err
+	}
+	if s.follower() {
+		client, ctx, err := s.leaderClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return client.AddToTxn(ctx, req)
+	}
+	records := make([]*api.Record, 0, len(req.Records)+len(req.Offsets))
+	for _, record := range req.Records {
+		if record == nil {
+			return nil, errMissingField("records")
+		}
+		record.Control = api.Record_DATA
+		record.AppendTime = nil
+		tracing.Inject(ctx, record)
+		records = append(records, record)
+	}
+	for _, oc := range req.Offsets {
+		value, err := proto.Marshal(oc)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &api.Record{
+			Value:   value,
+			Control: api.Record_OFFSET_COMMIT,
+		})
+	}
+	offs, err := s.CommitLog.AppendTxn(ctx, req.TransactionId, records)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AddToTxnResponse{Offsets: offs[:len(req.Records)]}, nil
+}
+
+func (s *grpcServer) CommitTxn(ctx context.Context, req *api.CommitTxnRequest) (
+	*api.CommitTxnResponse,
+	error,
+) {
+	if err := s.authorize(ctx, produceAction); err != nil {
+		return nil, err
+	}
+	if err := s.checkTopic(req.Topic); err != nil {
+		return nil, err
+	}
+	if s.follower() {
+		client, ctx, err := s.leaderClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return client.CommitTxn(ctx, req)
+	}
+	if err := s.endTxn(ctx, req.TransactionId, api.Record_COMMIT); err != nil {
+		return nil, err
+	}
+	return &api.CommitTxnResponse{}, nil
+}
+
+func (s *grpcServer) AbortTxn(ctx context.Context, req *api.AbortTxnRequest) (
+	*api.AbortTxnResponse,
+	error,
+) {
+	if err := s.authorize(ctx, produceAction); err != nil {
+		return nil, err
+	}
+	if err := s.checkTopic(req.Topic); err != nil {
+		return nil, err
+	}
+	if s.follower() {
+		client, ctx, err := s.leaderClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return client.AbortTxn(ctx, req)
+	}
+	if err := s.endTxn(ctx, req.TransactionId, api.Record_ABORT); err != nil {
+		return nil, err
+	}
+	return &api.AbortTxnResponse{}, nil
+}
+
+// FetchOffset returns the offset last committed by a consumer group.
+func (s *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (
+	*api.FetchOffsetResponse,
+	error,
+) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	off, err := s.CommitLog.CommittedOffset(req.Group)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FetchOffsetResponse{Offset: off}, nil
+}
+
+func (s *grpcServer) endTxn(
+	ctx context.Context,
+	id uint64,
+	control api.Record_Control,
+) error {
+	_, err := s.CommitLog.Append(ctx, &api.Record{
+		TransactionId: id,
+		Control:       control,
+	})
+	return err
+}
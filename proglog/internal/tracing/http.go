@@ -0,0 +1,20 @@
+package tracing
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Handler starts a span for each request served by next, continuing the
+// trace propagated in the request's traceparent header.
+func Handler(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(
+		next,
+		"proglog",
+		otelhttp.WithPropagators(propagator),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "HTTP " + r.Method
+		}),
+	)
+}
@@ -0,0 +1,126 @@
+// Package tracing traces requests through proglog with OpenTelemetry. Spans
+// start in the gRPC and HTTP servers and continue into the log, and the
+// trace context of each produce is stored in the record's headers so the
+// spans that later deliver the record link back to it.
+package tracing
+
+import (
+	"context"
+	"io"
+
+	api "github.com/mstreet3/proglog/api/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer starts spans from the global tracer provider, so they're only
+// recorded once one is configured
+var tracer = otel.Tracer("github.com/mstreet3/proglog/internal/tracing")
+
+// propagator carries trace context in W3C traceparent and tracestate
+// entries, in gRPC metadata, HTTP headers and record headers alike
+var propagator = propagation.TraceContext{}
+
+// NewProvider creates a tracer provider that batches spans and writes them
+// to w as JSON, one span per object. Spans are only recorded once the
+// provider is installed with otel.SetTracerProvider and are flushed to w
+// when it's shut down.
+func NewProvider(w io.Writer) (*sdktrace.TracerProvider, error) {
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceNameKey.String("proglog"),
+		)),
+	), nil
+}
+
+// RecordCarrier carries trace context in a record's headers.
+type RecordCarrier struct {
+	Record *api.Record
+}
+
+var _ propagation.TextMapCarrier = RecordCarrier{}
+
+// Get returns the value of the header named key.
+func (c RecordCarrier) Get(key string) string {
+	for _, h := range c.Record.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Set replaces the value of the header named key.
+func (c RecordCarrier) Set(key, value string) {
+	for _, h := range c.Record.Headers {
+		if h.Key == key {
+			h.Value = []byte(value)
+			return
+		}
+	}
+	c.Record.Headers = append(c.Record.Headers, &api.Header{
+		Key:   key,
+		Value: []byte(value),
+	})
+}
+
+// Keys returns the names of the record's headers.
+func (c RecordCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.Record.Headers))
+	for _, h := range c.Record.Headers {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+// Inject stores the trace context of ctx in the record's headers. Records
+// produced outside a recorded span are left as they are.
+func Inject(ctx context.Context, record *api.Record) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	propagator.Inject(ctx, RecordCarrier{record})
+}
+
+// Extract returns the trace context the record was produced in, which is
+// invalid if it was produced outside a recorded span.
+func Extract(record *api.Record) trace.SpanContext {
+	ctx := propagator.Extract(context.Background(), RecordCarrier{record})
+	return trace.SpanContextFromContext(ctx)
+}
+
+// Deliver starts a span for handing records to a consumer, linked to the
+// spans the records were produced in.
+func Deliver(ctx context.Context, records ...*api.Record) (
+	context.Context,
+	trace.Span,
+) {
+	var links []trace.Link
+	for _, record := range records {
+		if sc := Extract(record); sc.IsValid() {
+			links = append(links, trace.Link{
+				SpanContext: sc,
+				Attributes: []attribute.KeyValue{
+					attribute.Int64("offset", int64(record.Offset)),
+				},
+			})
+		}
+	}
+	return tracer.Start(
+		ctx,
+		"deliver",
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("records", len(records))),
+	)
+}
@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	api "github.com/mstreet3/proglog/api/v1"
+	"github.com/mstreet3/proglog/internal/log"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(
+		sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+	)
+	dir, err := ioutil.TempDir("", "tracing-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	// The client propagates its span to the server in the metadata
+	ctx, clientSpan := otel.Tracer("test").Start(context.Background(), "produce")
+	var md metadata.MD
+	invoker := func(
+		ctx context.Context,
+		_ string,
+		_, _ interface{},
+		_ *grpc.ClientConn,
+		_ ...grpc.CallOption,
+	) error {
+		md, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	require.NoError(t, UnaryClientInterceptor(ctx, "", nil, nil, nil, invoker))
+	clientSpan.End()
+
+	// The server's span continues the trace into the log and the record
+	record := &api.Record{Value: []byte("hello world")}
+	info := &grpc.UnaryServerInfo{FullMethod: "/log.v1.Log/Produce"}
+	var serverSpan trace.SpanContext
+	handler := func(ctx context.Context, _ interface{}) (interface{}, error) {
+		serverSpan = trace.SpanContextFromContext(ctx)
+		Inject(ctx, record)
+		return l.Append(ctx, record)
+	}
+	_, err = UnaryServerInterceptor(
+		metadata.NewIncomingContext(context.Background(), md),
+		nil,
+		info,
+		handler,
+	)
+	require.NoError(t, err)
+	require.Equal(t, clientSpan.SpanContext().TraceID(), serverSpan.TraceID())
+	require.Equal(t, serverSpan.SpanID(), Extract(record).SpanID())
+
+	// Delivering the record links back to the produce
+	read, err := l.Read(context.Background(), 0)
+	require.NoError(t, err)
+	_, span := Deliver(context.Background(), read)
+	span.End()
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	require.Equal(
+		t,
+		clientSpan.SpanContext().SpanID(),
+		spans["log.v1.Log/Produce"].Parent().SpanID(),
+	)
+	require.Equal(t, serverSpan, spans["log.Append"].Parent())
+	require.Equal(
+		t,
+		spans["log.Append"].SpanContext(),
+		spans["segment.Append"].Parent(),
+	)
+	links := spans["deliver"].Links()
+	require.Len(t, links, 1)
+	require.Equal(t, serverSpan.SpanID(), links[0].SpanContext.SpanID())
+}